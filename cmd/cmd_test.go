@@ -2,11 +2,23 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/spf13/cobra"
+	"github.com/stephng3/DoubleUp/constants"
+	"github.com/stephng3/DoubleUp/download"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Utility functions
@@ -42,8 +54,38 @@ func checkNoErrorsAndOutputs(t *testing.T, output string, err error) {
 	}
 }
 
+// runDownloads is the real RunE of rootCmd, which tests of the flags replace
+var runDownloads func(cmd *cobra.Command, args []string) error
+
+// captureOutput runs f with os.Stdout and os.Stderr written to files, returning what was written to them
+func captureOutput(t *testing.T, f func()) (stdout, stderr string) {
+	var files [2]*os.File
+	for i := range files {
+		file, err := ioutil.TempFile("", "downloader-output")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		files[i] = file
+	}
+	realStdout, realStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = files[0], files[1]
+	defer func() { os.Stdout, os.Stderr = realStdout, realStderr }()
+	f()
+	var out [2][]byte
+	for i, file := range files {
+		var err error
+		if out[i], err = ioutil.ReadFile(file.Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return string(out[0]), string(out[1])
+}
+
 // Setup and teardown for each test case
 func TestMain(m *testing.M) {
+	runDownloads = rootCmd.RunE
 	rootCmd.RunE = func(_ *cobra.Command, args []string) error { return nil }
 	res := m.Run()
 	nThreads = 1
@@ -130,8 +172,8 @@ func TestInvalidURL(t *testing.T) {
 
 func TestInvalidFlags(t *testing.T) {
 	cmdInputs := [][]string{
-		{"unknown shorthand flag", "http://google.com", "-c", "1", "-d", "2"},
-		{"unknown shorthand flag", "http://google.com", "-d", "2"},
+		{"unknown shorthand flag", "http://google.com", "-c", "1", "-z", "2"},
+		{"unknown shorthand flag", "http://google.com", "-z", "2"},
 		{"unknown flag", "http://google.com", "--cThreads", "2"},
 	}
 
@@ -156,3 +198,494 @@ func TestInvalidArguments(t *testing.T) {
 		}
 	}
 }
+
+func TestResumeFlag(t *testing.T) {
+	output, err := executeCommand(rootCmd, "http://www.google.com", "--resume")
+	checkNoErrorsAndOutputs(t, output, err)
+	if !resume {
+		t.Error("resume flag not set")
+	}
+	resume = false
+}
+
+func TestOutputFlags(t *testing.T) {
+	out, err := executeCommand(rootCmd, "http://www.google.com", "-o", "out.html", "-d", "downloads", "--auto-rename")
+	checkNoErrorsAndOutputs(t, out, err)
+	if output != "out.html" || dir != "downloads" || clobber != download.AutoRename {
+		t.Errorf("output flags not set, got output %q dir %q policy %v", output, dir, clobber)
+	}
+	output, dir, autoRename = "", "", false
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--no-clobber", "--overwrite")
+	if !ErrorContains(err, "only one of --overwrite, --no-clobber and --auto-rename can be used") {
+		t.Error(err)
+	}
+	noClobber, overwrite = false, false
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "-o", "-", "--resume")
+	if !ErrorContains(err, "cannot resume a download written to stdout") {
+		t.Error(err)
+	}
+	output, resume = "", false
+}
+
+func TestChecksumFlags(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	out, err := executeCommand(rootCmd, "http://www.google.com", "--checksum", "sha256:"+sum, "--checksum-file", "SHA256SUMS")
+	checkNoErrorsAndOutputs(t, out, err)
+	if len(checksums) != 1 || checksums[0].String() != "sha256:"+sum || checksumFile != "SHA256SUMS" {
+		t.Errorf("checksum flags not set, got %v and %q", checksums, checksumFile)
+	}
+	checksumStrings, checksumFile = nil, ""
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--checksum", "sha256:abcd")
+	if !ErrorContains(err, "invalid sha256 checksum") {
+		t.Error(err)
+	}
+	checksumStrings = nil
+}
+
+func TestRetryFlags(t *testing.T) {
+	out, err := executeCommand(rootCmd, "http://www.google.com", "--retry-base-delay", "1s", "--retry-max-delay", "1m", "--retry-budget", "10")
+	checkNoErrorsAndOutputs(t, out, err)
+	if retryBaseDelay != time.Second || retryMaxDelay != time.Minute || retryBudget != 10 {
+		t.Errorf("retry flags not set, got %v %v %d", retryBaseDelay, retryMaxDelay, retryBudget)
+	}
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--retry-base-delay", "1m", "--retry-max-delay", "1s")
+	if !ErrorContains(err, "with the max delay at least the base delay") {
+		t.Error(err)
+	}
+	retryBaseDelay, retryMaxDelay = constants.DefaultRetryBaseDelay, constants.DefaultRetryMaxDelay
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--retry-budget", "-1")
+	if !ErrorContains(err, "retry budget less than 0") {
+		t.Error(err)
+	}
+	retryBudget = 0
+}
+
+func TestTimeoutFlags(t *testing.T) {
+	out, err := executeCommand(rootCmd, "http://www.google.com", "--idle-timeout", "5s", "--timeout", "1h", "--min-speed", "1000", "--stall-time", "10s")
+	checkNoErrorsAndOutputs(t, out, err)
+	if idleTimeout != 5*time.Second || timeout != time.Hour || minSpeed != 1000 || stallTime != 10*time.Second {
+		t.Errorf("timeout flags not set, got %v %v %d %v", idleTimeout, timeout, minSpeed, stallTime)
+	}
+	timeout, minSpeed = 0, 0
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--chunk-timeout", "-1s")
+	if !ErrorContains(err, "timeouts cannot be negative") {
+		t.Error(err)
+	}
+	chunkTimeout, idleTimeout, stallTime = 0, constants.DefaultIdleTimeout, constants.DefaultStallTime
+}
+
+func TestAutoFlag(t *testing.T) {
+	out, err := executeCommand(rootCmd, "http://www.google.com", "--auto")
+	checkNoErrorsAndOutputs(t, out, err)
+	if !autoConcurrency {
+		t.Error("auto flag not set")
+	}
+	autoConcurrency = false
+}
+
+func TestChunkSizeFlag(t *testing.T) {
+	out, err := executeCommand(rootCmd, "http://www.google.com", "-s", "4MiB")
+	checkNoErrorsAndOutputs(t, out, err)
+	if chunkSize != 4<<20 || autoChunkSize {
+		t.Errorf("chunk size not set, got %d auto %v", chunkSize, autoChunkSize)
+	}
+
+	out, err = executeCommand(rootCmd, "http://www.google.com", "--chunkSize", "auto")
+	checkNoErrorsAndOutputs(t, out, err)
+	if !autoChunkSize {
+		t.Error("auto chunk size not set")
+	}
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "-s", "4 parsecs")
+	if !ErrorContains(err, "invalid size") {
+		t.Error(err)
+	}
+	chunkSizeString = strconv.FormatInt(constants.DefaultChunkSize, 10)
+}
+
+func TestRateLimitFlags(t *testing.T) {
+	out, err := executeCommand(rootCmd, "http://www.google.com", "--limit-rate", "5MB/s", "--limit-rate-per-connection", "1MiB/s", "--limit-schedule", "09:00-17:00=1MB/s")
+	checkNoErrorsAndOutputs(t, out, err)
+	if rateLimit != 5000000 || connRateLimit != 1<<20 || len(rateSchedule) != 1 || rateSchedule[0].Rate != 1000000 {
+		t.Errorf("rate limit flags not set, got %d %d %v", rateLimit, connRateLimit, rateSchedule)
+	}
+	limitRate, limitConnRate, limitSchedule = "0", "0", nil
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--limit-schedule", "9am-5pm=1MB/s")
+	if !ErrorContains(err, "invalid rate window") {
+		t.Error(err)
+	}
+	limitSchedule = nil
+}
+
+func TestMirrorFlags(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "mirrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# Mirrors\nhttp://mirror2.example.com/file\n\nhttp://mirror3.example.com/file\n")
+	f.Close()
+
+	out, err := executeCommand(rootCmd, "http://www.google.com", "--mirror", "http://mirror1.example.com/file", "--mirror-file", f.Name())
+	checkNoErrorsAndOutputs(t, out, err)
+	if len(mirrors) != 3 || mirrors[0].Host != "mirror1.example.com" || mirrors[2].Host != "mirror3.example.com" {
+		t.Errorf("mirror flags not set, got %v", mirrors)
+	}
+	mirrorStrings, mirrorFile = nil, ""
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--mirror", "ftp://mirror1.example.com/file")
+	if !ErrorContains(err, "invalid mirror") {
+		t.Error(err)
+	}
+	mirrorStrings = nil
+}
+
+func TestMetalinkArgument(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "*.meta4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="a.iso"><url priority="2">http://mirror2.example.com/a.iso</url><url priority="1">http://mirror1.example.com/a.iso</url></file>
+  <file name="b.iso"><url>http://mirror1.example.com/b.iso</url></file>
+</metalink>`)
+	f.Close()
+
+	for _, source := range []string{f.Name(), "http://www.example.com/a.meta4"} {
+		out, err := executeCommand(rootCmd, source)
+		checkNoErrorsAndOutputs(t, out, err)
+		if metalinkSource != source || resource != nil {
+			t.Errorf("expected metalink %s, got %q and URL %v", source, metalinkSource, resource)
+		}
+	}
+
+	reqs, err := metalinkRequests(context.Background(), download.NewClient(download.Options{}), f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].URL.Host != "mirror1.example.com" || len(reqs[0].Mirrors) != 1 || reqs[1].Output != "b.iso" {
+		t.Errorf("unexpected requests from metalink: %+v", reqs)
+	}
+	output = "out.iso"
+	if _, err := metalinkRequests(context.Background(), download.NewClient(download.Options{}), f.Name()); !ErrorContains(err, "cannot be used") {
+		t.Errorf("expected --output to be rejected for several files, got %v", err)
+	}
+	output, metalinkSource = "", ""
+}
+
+func TestPieceManifestFlag(t *testing.T) {
+	out, err := executeCommand(rootCmd, "http://www.google.com", "--piece-manifest", "file.zsync")
+	checkNoErrorsAndOutputs(t, out, err)
+	if pieceManifest != "file.zsync" {
+		t.Errorf("piece manifest not set, got %q", pieceManifest)
+	}
+	pieceManifest = ""
+}
+
+func TestInputFileFlags(t *testing.T) {
+	out, err := executeCommand(rootCmd, "-i", "urls.txt", "-j", "3")
+	checkNoErrorsAndOutputs(t, out, err)
+	if inputFile != "urls.txt" || concurrentFiles != 3 || resource != nil {
+		t.Errorf("input file flags not set, got %q, %d, %v", inputFile, concurrentFiles, resource)
+	}
+
+	for _, args := range [][]string{
+		{"-i", "urls.txt", "http://www.google.com"},
+		{"-i", "urls.txt", "-o", "out"},
+		{"-i", "urls.txt", "-j", "0"},
+	} {
+		if _, err := executeCommand(rootCmd, args...); err == nil {
+			t.Errorf("expected %v to be rejected", args)
+		}
+	}
+	inputFile, concurrentFiles, output = "", 1, ""
+}
+
+func TestHostLimitFlags(t *testing.T) {
+	out, err := executeCommand(rootCmd, "http://www.google.com", "--max-connections-per-host", "4", "--host-limit", "*.example.com=2")
+	checkNoErrorsAndOutputs(t, out, err)
+	if hostConnections != 4 || len(hostLimits) != 1 || hostLimits[0].Connections != 2 {
+		t.Errorf("host limit flags not set, got %d, %v", hostConnections, hostLimits)
+	}
+	hostLimitArgs = nil
+
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--host-limit", "example.com")
+	if !ErrorContains(err, "invalid host limit") {
+		t.Error(err)
+	}
+	hostConnections, hostLimitArgs = 0, nil
+}
+
+func TestServeFlags(t *testing.T) {
+	for _, c := range []struct{ address, network, addr string }{
+		{"127.0.0.1:6800", "tcp", "127.0.0.1:6800"},
+		{":8080", "tcp", ":8080"},
+		{"unix:/run/downloader.sock", "unix", "/run/downloader.sock"},
+	} {
+		network, addr, err := parseListenAddress(c.address)
+		if err != nil || network != c.network || addr != c.addr {
+			t.Errorf("%s: expected %s %s, got %s %s %v", c.address, c.network, c.addr, network, addr, err)
+		}
+	}
+
+	_, err := executeCommand(rootCmd, "serve", "--listen", "localhost")
+	if !ErrorContains(err, "invalid listen address") {
+		t.Error(err)
+	}
+	_, err = executeCommand(rootCmd, "serve", "--listen", "unix:")
+	if !ErrorContains(err, "missing Unix socket path") {
+		t.Error(err)
+	}
+	// Connection flags are shared with serve
+	_, err = executeCommand(rootCmd, "serve", "-c", "0")
+	if !ErrorContains(err, "nThreads less than 1") {
+		t.Error(err)
+	}
+	_, err = executeCommand(rootCmd, "serve", "http://www.google.com")
+	if !ErrorContains(err, "unknown command") {
+		t.Error(err)
+	}
+	nThreads, listenAddress = 1, constants.DefaultListenAddress
+}
+
+func TestProgressPrinter(t *testing.T) {
+	began := time.Unix(0, 0)
+	resource, _ := url.Parse("http://example.com/a")
+	events := []download.Event{
+		{Type: download.EventStarted, Time: began, Path: "a", Total: 1000},
+		{Type: download.EventChunkCompleted, Time: began.Add(time.Second), Completed: 100, Total: 1000, Speed: 100, ETA: 9 * time.Second},
+		{Type: download.EventChunkRetried, Time: began.Add(2 * time.Second), Completed: 100, Total: 1000, Attempt: 1, Start: 100, End: 200, Err: errors.New("EOF")},
+		{Type: download.EventProgress, Time: began.Add(6 * time.Second), Completed: 600, Total: 1000, Speed: 100, ETA: 4 * time.Second,
+			Transfers: []download.Transfer{{Connection: 0, URL: resource, Start: 100, End: 200, Written: 50, Speed: 10, Attempt: 1}}},
+		{Type: download.EventFinished, Time: began.Add(10 * time.Second), Completed: 1000, Total: 1000},
+	}
+	render := func(tty bool) string {
+		var out bytes.Buffer
+		p := &progressPrinter{out: &out, errs: &out, tty: tty, width: 80, connections: true}
+		for _, e := range events {
+			p.print(e)
+		}
+		return out.String()
+	}
+
+	// Plain lines every ProgressLogInterval and at the end
+	plain := render(false)
+	for _, want := range []string{"a\n", "Attempt 1: Download of range 100-200 failed:\n EOF\n",
+		"Progress: 600B of 1000B (60.0%), 100B/s, average 100B/s, ETA 4s\n",
+		"Progress: 1000B of 1000B (100.0%), average 100B/s\n"} {
+		if !strings.Contains(plain, want) {
+			t.Errorf("expected %q in %q", want, plain)
+		}
+	}
+	if strings.Contains(plain, "\x1b") || strings.Count(plain, "Progress:") != 2 {
+		t.Errorf("unexpected plain progress %q", plain)
+	}
+
+	// The display is redrawn in place, the connection retrying highlighted
+	tty := render(true)
+	for _, want := range []string{"\x1b[1A\x1b[J", yellow + "  #1  example.com 100-200  50.0% 10B/s  retry 1" + reset} {
+		if !strings.Contains(tty, want) {
+			t.Errorf("expected %q in %q", want, tty)
+		}
+	}
+}
+
+// The downloads of a batch are shown as a single line of their totals
+func TestBatchProgress(t *testing.T) {
+	began := time.Unix(0, 0)
+	a, _ := url.Parse("http://example.com/a")
+	b, _ := url.Parse("http://example.com/b")
+	var out bytes.Buffer
+	progress := newBatchProgress(&out, []download.Request{{URL: a}, {URL: b}})
+	progress.p.errs = &out
+	events := []struct {
+		download int
+		event    download.Event
+	}{
+		{0, download.Event{Type: download.EventStarted, Time: began, Path: "a", Total: 1000}},
+		{0, download.Event{Type: download.EventProgress, Time: began.Add(time.Second), Completed: 500, Total: 1000, Speed: 500}},
+		{1, download.Event{Type: download.EventFailed, Time: began.Add(2 * time.Second), Err: errors.New("404 Not Found")}},
+		{0, download.Event{Type: download.EventProgress, Time: began.Add(6 * time.Second), Completed: 600, Total: 1000, Speed: 100}},
+		{0, download.Event{Type: download.EventFinished, Time: began.Add(10 * time.Second), Completed: 1000, Total: 1000}},
+	}
+	for _, e := range events {
+		progress.subscriber(e.download)(e.event)
+	}
+	for _, want := range []string{"a\n", "http://example.com/b failed: 404 Not Found\n",
+		"Progress: 1 of 2 files, 600B of 1000B (60.0%), 100B/s, average 100B/s, ETA 4s\n",
+		"Progress: 2 of 2 files, 1000B of 1000B (100.0%), average 100B/s\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in %q", want, out.String())
+		}
+	}
+}
+
+func TestQuietFlag(t *testing.T) {
+	_, err := executeCommand(rootCmd, "http://www.google.com", "-q", "--show-connections")
+	if err != nil || !quiet || !showConnections {
+		t.Errorf("expected the progress flags to be set, got %v", err)
+	}
+	quiet, showConnections = false, false
+}
+
+func TestOutputFormatFlag(t *testing.T) {
+	_, err := executeCommand(rootCmd, "http://www.google.com", "--output-format", "xml")
+	if !ErrorContains(err, "invalid output format") {
+		t.Error(err)
+	}
+	_, err = executeCommand(rootCmd, "http://www.google.com", "--output-format", "json", "-o", "-")
+	if !ErrorContains(err, "cannot print JSON to stdout") {
+		t.Error(err)
+	}
+	outputFormat, output = outputText, ""
+}
+
+// JSON output is an event per line, ending with a summary of the download.
+// Retries are counted by connection, whatever is left of the range retried
+func TestJSONPrinter(t *testing.T) {
+	began := time.Unix(0, 0)
+	resource, _ := url.Parse("http://example.com/a")
+	var out bytes.Buffer
+	var passed int
+	events := newJSONPrinter(&out).subscriber(download.Request{URL: resource}, func(download.Event) { passed++ })
+	for _, e := range []download.Event{
+		{Type: download.EventProbed, Time: began, Total: 1000, Capabilities: &download.Capabilities{Length: 1000, CanRange: true}},
+		{Type: download.EventStarted, Time: began, Path: "a", Total: 1000},
+		{Type: download.EventChunkStarted, Time: began, Connection: 1, URL: resource, Start: 0, End: 500, Total: 1000},
+		{Type: download.EventChunkRetried, Time: began, Connection: 1, URL: resource, Start: 0, End: 500, Attempt: 1, Total: 1000, Err: errors.New("EOF")},
+		// Part of the span was written and the rest of it stolen by another connection before it failed again
+		{Type: download.EventChunkRetried, Time: began, Connection: 1, URL: resource, Start: 100, End: 250, Attempt: 2, Total: 1000, Err: errors.New("EOF")},
+		{Type: download.EventChunkRetried, Time: began, Connection: 0, URL: resource, Start: 250, End: 500, Attempt: 1, Total: 1000, Err: errors.New("EOF")},
+		{Type: download.EventChunkCompleted, Time: began.Add(time.Second), Start: 0, End: 500, Completed: 500, Total: 1000},
+		{Type: download.EventFinished, Time: began.Add(2 * time.Second), Completed: 1000, Total: 1000, Result: &download.Result{
+			Path: "a", Bytes: 1000, Duration: 2 * time.Second, Connections: 2,
+			Checksums: []download.Checksum{{Algorithm: "md5", Sum: []byte{0xab}}},
+		}},
+	} {
+		events(e)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 9 || passed != 8 {
+		t.Fatalf("expected 8 events and a summary, got %d lines and passed on %d: %s", len(lines), passed, out.String())
+	}
+	var retried jsonEvent
+	if err := json.Unmarshal([]byte(lines[3]), &retried); err != nil || retried.Type != download.EventChunkRetried ||
+		retried.URL != resource.String() || retried.Error != "EOF" || *retried.Chunk != (jsonChunk{Connection: 2, URL: resource.String(), End: 500, Attempt: 1}) {
+		t.Errorf("unexpected event %s: %v", lines[3], err)
+	}
+	var summary jsonSummary
+	if err := json.Unmarshal([]byte(lines[8]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Type != "summary" || summary.Path != "a" || summary.Bytes != 1000 || summary.Duration != 2 || summary.Speed != 500 ||
+		summary.Connections != 2 || len(summary.Retries) != 2 ||
+		summary.Retries[0] != (jsonRetries{Connection: 1, Retries: 1}) || summary.Retries[1] != (jsonRetries{Connection: 2, Retries: 2}) ||
+		len(summary.Checksums) != 1 || summary.Checksums[0] != "md5:ab" || summary.Error != "" {
+		t.Errorf("unexpected summary %s", lines[8])
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, ExitOK},
+		{errors.New("3 of 4 downloads failed"), ExitFailure},
+		{fmt.Errorf("input line 2: %w", &url.Error{Op: "parse", URL: "out=a", Err: errors.New("invalid URI for request")}), ExitFailure},
+		{&download.StatusError{Code: 404, Status: "404 Not Found"}, ExitHTTP},
+		{&download.RetryError{Err: &download.StatusError{Code: 503, Status: "503 Service Unavailable"}}, ExitHTTP},
+		{&download.RetryError{Err: download.ErrStalled}, ExitNetwork},
+		{context.DeadlineExceeded, ExitNetwork},
+		{&download.ChecksumError{Algorithm: "md5"}, ExitChecksum},
+		{download.ErrResourceChanged, ExitChanged},
+		{fmt.Errorf("download interrupted: %w", context.Canceled), ExitInterrupted},
+	} {
+		if code := ExitCode(c.err); code != c.code {
+			t.Errorf("%v: expected exit code %d, got %d", c.err, c.code, code)
+		}
+	}
+
+	_, err := executeCommand(rootCmd, "http://www.google.com", "--nope")
+	if ExitCode(err) != ExitUsage {
+		t.Errorf("expected an unknown flag to be a usage error, got %v", err)
+	}
+	_, err = executeCommand(rootCmd, "http://www.google.com", "-c", "0")
+	if ExitCode(err) != ExitUsage {
+		t.Errorf("expected an invalid flag to be a usage error, got %v", err)
+	}
+	_, err = executeCommand(rootCmd, "serve", "http://www.google.com")
+	if ExitCode(err) != ExitUsage {
+		t.Errorf("expected an argument to serve to be a usage error, got %v", err)
+	}
+	nThreads = 1
+}
+
+// A batch with a failed download prints the outcome of each and exits with a failure
+func TestInputFileDownload(t *testing.T) {
+	content := []byte("some content to download")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	tmp, err := ioutil.TempDir("", "downloader-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	urls := filepath.Join(tmp, "urls.txt")
+	if err := ioutil.WriteFile(urls, []byte(server.URL+"/file out=a\n"+server.URL+"/missing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rootCmd.RunE = runDownloads
+	defer func() { rootCmd.RunE = func(_ *cobra.Command, args []string) error { return nil } }()
+	rootCmd.SetOutput(new(bytes.Buffer))
+	rootCmd.SetArgs([]string{"-i", urls, "-d", tmp, "--output-format", "json"})
+	var code int
+	stdout, stderr := captureOutput(t, func() { code = ExitCode(Execute()) })
+	inputFile, dir, outputFormat = "", "", outputText
+
+	if code != ExitFailure {
+		t.Errorf("expected exit code %d, got %d", ExitFailure, code)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tmp, "a"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("expected the first file to be downloaded, got %q, %v", got, err)
+	}
+	// Each download ends with a summary on stdout
+	summaries := map[string]jsonSummary{}
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		var summary jsonSummary
+		if err := json.Unmarshal([]byte(line), &summary); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		if summary.Type == "summary" {
+			summaries[summary.URL] = summary
+		}
+	}
+	if ok := summaries[server.URL+"/file"]; len(summaries) != 2 || ok.Error != "" || ok.Bytes != int64(len(content)) || ok.Path != filepath.Join(tmp, "a") {
+		t.Errorf("unexpected summaries %+v", summaries)
+	}
+	if missing := summaries[server.URL+"/missing"]; !strings.Contains(missing.Error, "404") {
+		t.Errorf("expected the missing file to fail with a 404, got %+v", missing)
+	}
+	// The table of the batch goes to stderr
+	for _, want := range []string{"OK      " + server.URL + "/file", "FAILED  " + server.URL + "/missing", "1 of 2 downloads succeeded"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("expected %q in the batch summary, got %q", want, stderr)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.com/spf13/cobra"
+	"github.com/stephng3/DoubleUp/download"
+)
+
+// Exit codes of the command, documented in the README
+const (
+	ExitOK          = 0
+	ExitFailure     = 1   // Any other failure, including some downloads of --input-file failing
+	ExitUsage       = 2   // Invalid flags or arguments
+	ExitHTTP        = 3   // The server answered with an error status, e.g. 404, or 503 until retries ran out
+	ExitNetwork     = 4   // Network errors, stalled transfers or timeouts until retries ran out
+	ExitChecksum    = 5   // The download does not match its checksum
+	ExitChanged     = 6   // The resource changed on the server during the download
+	ExitDiskFull    = 7   // No space left to write the download
+	ExitInterrupted = 130 // Interrupted, the download can be resumed with --resume
+)
+
+// usageError is an invalid command line
+type usageError struct {
+	error
+}
+
+func (e usageError) Unwrap() error {
+	return e.error
+}
+
+// usage marks the errors of a validating function as usage errors
+func usage(validate func(cmd *cobra.Command, args []string) error) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := validate(cmd, args); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+}
+
+// ExitCode is the code to exit with after the command failed with err
+func ExitCode(err error) int {
+	var usageErr usageError
+	var statusErr *download.StatusError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &usageErr):
+		return ExitUsage
+	case errors.Is(err, download.ErrCancelled):
+		return ExitInterrupted
+	case errors.Is(err, download.ErrDiskFull):
+		return ExitDiskFull
+	case errors.Is(err, download.ErrChecksumMismatch):
+		return ExitChecksum
+	case errors.Is(err, download.ErrResourceChanged):
+		return ExitChanged
+	case errors.As(err, &statusErr):
+		return ExitHTTP
+	case errors.Is(err, download.ErrRetriesExhausted), errors.Is(err, context.DeadlineExceeded), download.Temporary(err):
+		return ExitNetwork
+	}
+	return ExitFailure
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/stephng3/DoubleUp/download"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Values of --output-format
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// jsonEvent is a download.Event as printed by --output-format json
+type jsonEvent struct {
+	Type      download.EventType `json:"type"`
+	Time      time.Time          `json:"time"`
+	URL       string             `json:"url"` // Of the download
+	Completed int64              `json:"completed"`
+	Total     int64              `json:"total,omitempty"`
+	Speed     int64              `json:"speed"`         // Bytes/s over the last few seconds
+	ETA       float64            `json:"eta,omitempty"` // Seconds
+	Resource  *jsonResource      `json:"resource,omitempty"`
+	Path      string             `json:"path,omitempty"`
+	Chunk     *jsonChunk         `json:"chunk,omitempty"`
+	Transfers []jsonChunk        `json:"transfers,omitempty"`
+	Mirror    string             `json:"mirror,omitempty"`
+	Message   string             `json:"message,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// jsonResource is what probing the resource found
+type jsonResource struct {
+	Length       int64  `json:"length"`
+	Ranges       bool   `json:"ranges"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Filename     string `json:"filename,omitempty"`
+}
+
+// jsonChunk is a byte range of chunk events and transfers, End excluded
+type jsonChunk struct {
+	Connection int    `json:"connection,omitempty"` // Numbered from 1, 0 if not known
+	URL        string `json:"url,omitempty"`
+	Start      int64  `json:"start"`
+	End        int64  `json:"end"`
+	Attempt    int    `json:"attempt,omitempty"`
+	Written    int64  `json:"written,omitempty"`
+	Speed      int64  `json:"speed,omitempty"`
+}
+
+// jsonSummary ends the events of a download
+type jsonSummary struct {
+	Type        string        `json:"type"` // Always summary
+	URL         string        `json:"url"`
+	Path        string        `json:"path,omitempty"`
+	Bytes       int64         `json:"bytes"`
+	Duration    float64       `json:"duration"` // Seconds
+	Speed       int64         `json:"speed"`    // Average bytes/s, not counting resumed bytes
+	Connections int           `json:"connections"`
+	Retries     []jsonRetries `json:"retries"`
+	Checksums   []string      `json:"checksums"` // Verified, as <algorithm>:<hex>
+	Error       string        `json:"error,omitempty"`
+}
+
+// jsonRetries counts the failed attempts of a connection. Chunks are not told apart by their range,
+// which shrinks as they progress and other connections take over part of them
+type jsonRetries struct {
+	Connection int `json:"connection"` // Numbered from 1
+	Retries    int `json:"retries"`
+}
+
+// jsonPrinter writes the events of downloads as newline-delimited JSON, each download ending with a summary
+type jsonPrinter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONPrinter(w io.Writer) *jsonPrinter {
+	return &jsonPrinter{enc: json.NewEncoder(w)}
+}
+
+// jsonDownload is what the summary of a download is made of
+type jsonDownload struct {
+	summary jsonSummary
+	began   time.Time
+	resumed int64
+	retries map[int]int // By connection
+}
+
+// subscriber returns the subscriber of req's events, passing them on to next if it is not nil
+func (p *jsonPrinter) subscriber(req download.Request, next func(download.Event)) func(download.Event) {
+	d := &jsonDownload{
+		summary: jsonSummary{Type: "summary", URL: req.URL.String(), Retries: []jsonRetries{}, Checksums: []string{}},
+		retries: map[int]int{},
+	}
+	return func(e download.Event) {
+		p.print(d, e)
+		if next != nil {
+			next(e)
+		}
+	}
+}
+
+func (p *jsonPrinter) print(d *jsonDownload, e download.Event) {
+	out := jsonEvent{
+		Type:      e.Type,
+		Time:      e.Time,
+		URL:       d.summary.URL,
+		Completed: e.Completed,
+		Total:     e.Total,
+		Speed:     int64(e.Speed),
+		ETA:       e.ETA.Seconds(),
+		Path:      e.Path,
+		Message:   e.Message,
+	}
+	if e.Err != nil {
+		out.Error = e.Err.Error()
+	}
+	if d.began.IsZero() {
+		d.began = e.Time
+	}
+	switch e.Type {
+	case download.EventProbed:
+		caps := e.Capabilities
+		out.Resource = &jsonResource{Length: caps.Length, Ranges: caps.CanRange, ETag: caps.ETag, LastModified: caps.LastModified, Filename: caps.Filename}
+	case download.EventStarted:
+		d.summary.Path, d.resumed = e.Path, e.Completed
+	case download.EventChunkStarted, download.EventChunkRetried, download.EventChunkCompleted:
+		out.Chunk = &jsonChunk{Start: e.Start, End: e.End, Attempt: e.Attempt}
+		if e.Type != download.EventChunkCompleted {
+			out.Chunk.Connection, out.Chunk.URL = e.Connection+1, e.URL.String()
+		}
+		if e.Connection >= d.summary.Connections {
+			d.summary.Connections = e.Connection + 1
+		}
+		if e.Type == download.EventChunkRetried {
+			d.retries[e.Connection+1]++
+		}
+	case download.EventProgress:
+		for _, t := range e.Transfers {
+			out.Transfers = append(out.Transfers, jsonChunk{
+				Connection: t.Connection + 1,
+				URL:        t.URL.String(),
+				Start:      t.Start,
+				End:        t.End,
+				Attempt:    t.Attempt,
+				Written:    t.Written,
+				Speed:      int64(t.Speed),
+			})
+		}
+	case download.EventMirrorDropped:
+		out.Mirror = e.URL.String()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(out)
+	if e.Type == download.EventFinished || e.Type == download.EventFailed {
+		p.enc.Encode(d.finish(e))
+	}
+}
+
+// finish completes the summary with the event ending the download
+func (d *jsonDownload) finish(e download.Event) jsonSummary {
+	s := d.summary
+	s.Bytes = e.Completed
+	duration := e.Time.Sub(d.began)
+	if res := e.Result; res != nil {
+		s.Path, s.Bytes, s.Connections, duration = res.Path, res.Bytes, res.Connections, res.Duration
+		for _, checksum := range res.Checksums {
+			s.Checksums = append(s.Checksums, checksum.String())
+		}
+	}
+	if e.Err != nil {
+		s.Error = e.Err.Error()
+	}
+	s.Duration = duration.Seconds()
+	if duration > 0 {
+		s.Speed = int64(float64(s.Bytes-d.resumed) / duration.Seconds())
+	}
+	for connection, retries := range d.retries {
+		s.Retries = append(s.Retries, jsonRetries{Connection: connection, Retries: retries})
+	}
+	sort.Slice(s.Retries, func(i, j int) bool { return s.Retries[i].Connection < s.Retries[j].Connection })
+	return s
+}
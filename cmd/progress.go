@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stephng3/DoubleUp/constants"
+	"github.com/stephng3/DoubleUp/download"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ANSI escape sequences of the progress display on a terminal
+const (
+	clearBelow = "\x1b[%dA\x1b[J" // Move the cursor up some lines and clear everything below it
+	red        = "\x1b[31m"
+	yellow     = "\x1b[33m"
+	reset      = "\x1b[0m"
+)
+
+// progressPrinter renders the events of a download. On a terminal it redraws the totals in place,
+// with a line per connection if connections is set. Otherwise it logs them every ProgressLogInterval
+type progressPrinter struct {
+	out         io.Writer // Progress and notices
+	errs        io.Writer // Failed attempts
+	tty         bool
+	width       int // Of the terminal, lines are cut to it so they do not wrap
+	connections bool
+
+	files     string    // Files done of a batch, shown before the bytes
+	began     time.Time // When writing started, for the average speed
+	resumed   int64     // Bytes already there when writing started
+	last      download.Event
+	transfers []download.Transfer
+	drawn     int // Lines of the display on the terminal
+	lastDraw  time.Time
+}
+
+// newProgressPrinter renders progress to out, as a live display if it is a terminal
+func newProgressPrinter(out io.Writer, connections bool) *progressPrinter {
+	p := &progressPrinter{out: out, errs: os.Stderr, width: 80, connections: connections}
+	if f, ok := out.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		p.tty = true
+		if width, _, err := term.GetSize(int(f.Fd())); err == nil && width > 0 {
+			p.width = width
+		}
+	}
+	return p
+}
+
+// print is the subscriber of download.Request.Events
+func (p *progressPrinter) print(e download.Event) {
+	switch e.Type {
+	case download.EventStarted:
+		if e.Path != download.Stdout {
+			p.println(p.out, "%s", e.Path)
+		}
+		p.began, p.resumed, p.last, p.lastDraw = e.Time, e.Completed, e, e.Time
+	case download.EventNotice:
+		p.println(p.out, "%s", e.Message)
+	case download.EventChunkRetried:
+		p.println(p.errs, "%sAttempt %d: Download of range %d-%d failed:%s\n %v", p.color(red), e.Attempt, e.Start, e.End, p.color(reset), e.Err)
+	case download.EventMirrorDropped:
+		p.println(p.errs, "Dropping mirror %s: %v", e.URL, e.Err)
+	case download.EventChunkCompleted, download.EventProgress:
+		if p.began.IsZero() {
+			return
+		}
+		p.last = e
+		if e.Type == download.EventProgress {
+			p.transfers = e.Transfers
+		}
+		if p.tty && e.Time.Sub(p.lastDraw) >= constants.ProgressRedrawInterval {
+			p.draw(e.Time)
+		} else if !p.tty && e.Time.Sub(p.lastDraw) >= constants.ProgressLogInterval {
+			p.lastDraw = e.Time
+			fmt.Fprintln(p.out, p.summary())
+		}
+	case download.EventFinished, download.EventFailed:
+		if p.began.IsZero() {
+			return
+		}
+		// The totals stay behind, without the connections that are gone by now
+		p.last, p.transfers = e, nil
+		if p.tty {
+			p.draw(e.Time)
+			p.drawn = 0
+		} else {
+			fmt.Fprintln(p.out, p.summary())
+		}
+	}
+}
+
+// println prints a line to w above the display, if any
+func (p *progressPrinter) println(w io.Writer, format string, a ...interface{}) {
+	p.clear()
+	fmt.Fprintf(w, format+"\n", a...)
+	if p.tty && !p.began.IsZero() {
+		p.draw(p.lastDraw)
+	}
+}
+
+// color is an escape sequence to print, if printing to a terminal
+func (p *progressPrinter) color(sequence string) string {
+	if !p.tty {
+		return ""
+	}
+	return sequence
+}
+
+// clear removes the display from the terminal
+func (p *progressPrinter) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, clearBelow, p.drawn)
+		p.drawn = 0
+	}
+}
+
+// draw replaces the display on the terminal with the latest progress
+func (p *progressPrinter) draw(now time.Time) {
+	var b strings.Builder
+	if p.drawn > 0 {
+		fmt.Fprintf(&b, clearBelow, p.drawn)
+	}
+	lines := []string{p.cut(p.summary())}
+	if p.connections {
+		for _, t := range p.transfers {
+			line := fmt.Sprintf("  #%-2d %s %d-%d %5.1f%% %s/s", t.Connection+1, t.URL.Host, t.Start, t.End,
+				percent(t.Written, t.End-t.Start), download.FormatSize(int64(t.Speed)))
+			if t.Attempt > 0 {
+				line = yellow + p.cut(fmt.Sprintf("%s  retry %d", line, t.Attempt)) + reset
+			} else {
+				line = p.cut(line)
+			}
+			lines = append(lines, line)
+		}
+	}
+	for _, line := range lines {
+		b.WriteString(line + "\n")
+	}
+	fmt.Fprint(p.out, b.String())
+	p.drawn, p.lastDraw = len(lines), now
+}
+
+// cut shortens a line to the width of the terminal
+func (p *progressPrinter) cut(line string) string {
+	if runes := []rune(line); len(runes) > p.width-1 {
+		return string(runes[:p.width-1])
+	}
+	return line
+}
+
+// summary describes the progress of the download so far
+func (p *progressPrinter) summary() string {
+	e := p.last
+	var b strings.Builder
+	b.WriteString("Progress: ")
+	if p.files != "" {
+		b.WriteString(p.files + ", ")
+	}
+	b.WriteString(download.FormatSize(e.Completed))
+	if e.Total > 0 {
+		fmt.Fprintf(&b, " of %s (%.1f%%)", download.FormatSize(e.Total), percent(e.Completed, e.Total))
+	}
+	var average float64
+	if elapsed := e.Time.Sub(p.began).Seconds(); elapsed > 0 {
+		average = float64(e.Completed-p.resumed) / elapsed
+	}
+	if e.Type != download.EventFinished {
+		fmt.Fprintf(&b, ", %s/s", download.FormatSize(int64(e.Speed)))
+	}
+	fmt.Fprintf(&b, ", average %s/s", download.FormatSize(int64(average)))
+	if e.ETA > 0 && e.Type != download.EventFinished {
+		fmt.Fprintf(&b, ", ETA %s", e.ETA.Round(time.Second))
+	}
+	return b.String()
+}
+
+// batchProgress renders the downloads of a batch as a single display of their totals,
+// printing the path of each download as it starts and the error of each that fails
+type batchProgress struct {
+	mu        sync.Mutex // Downloads report their events from goroutines of their own
+	p         *progressPrinter
+	names     []string         // Of each download, its URL until it starts writing to a path
+	downloads []download.Event // Latest progress of each download
+	failed    []bool
+	done      int
+}
+
+// newBatchProgress renders the progress of the downloads of reqs to out, as a live display if it is a terminal
+func newBatchProgress(out io.Writer, reqs []download.Request) *batchProgress {
+	b := &batchProgress{
+		p:         newProgressPrinter(out, false),
+		names:     make([]string, len(reqs)),
+		downloads: make([]download.Event, len(reqs)),
+		failed:    make([]bool, len(reqs)),
+	}
+	for i, req := range reqs {
+		b.names[i] = req.URL.String()
+	}
+	b.p.files = fmt.Sprintf("0 of %d files", len(reqs))
+	return b
+}
+
+// subscriber is the subscriber of download.Request.Events for download i of the batch
+func (b *batchProgress) subscriber(i int) func(download.Event) {
+	return func(e download.Event) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.print(i, e)
+	}
+}
+
+func (b *batchProgress) print(i int, e download.Event) {
+	p := b.p
+	if p.began.IsZero() {
+		p.began, p.lastDraw = e.Time, e.Time
+	}
+	switch e.Type {
+	case download.EventStarted:
+		b.names[i] = e.Path
+		p.resumed += e.Completed
+		p.println(p.out, "%s", e.Path)
+	case download.EventChunkCompleted, download.EventProgress:
+		b.downloads[i] = e
+	case download.EventFinished:
+		b.downloads[i] = e
+		b.done++
+	case download.EventFailed:
+		// A failed download no longer counts towards the totals
+		b.downloads[i], b.failed[i] = download.Event{}, true
+		b.done++
+		p.println(p.errs, "%s%s failed:%s %v", p.color(red), b.names[i], p.color(reset), e.Err)
+	default:
+		return
+	}
+
+	// The total is only known once every download still on has reported its size
+	totals := download.Event{Type: download.EventProgress, Time: e.Time}
+	known := true
+	for j, d := range b.downloads {
+		totals.Completed += d.Completed
+		totals.Total += d.Total
+		if d.Type != download.EventFinished {
+			totals.Speed += d.Speed
+		}
+		known = known && (d.Total > 0 || b.failed[j])
+	}
+	if !known {
+		totals.Total = 0
+	} else if totals.Speed > 0 {
+		totals.ETA = time.Duration(float64(totals.Total-totals.Completed) / totals.Speed * float64(time.Second))
+	}
+	if b.done == len(b.downloads) {
+		totals.Type = download.EventFinished
+	}
+	p.files = fmt.Sprintf("%d of %d files", b.done, len(b.downloads))
+	p.print(totals)
+}
+
+// percent is n as a percentage of total
+func percent(n int64, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
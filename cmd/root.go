@@ -1,65 +1,526 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/stephng3/DoubleUp/constants"
 	"github.com/stephng3/DoubleUp/download"
+	"github.com/stephng3/DoubleUp/metalink"
+	"io"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 var (
 	// Flags
-	nThreads    int
-	chunkSize   int64
-	maxAttempts int
-	resource    *url.URL
+	nThreads        int
+	autoConcurrency bool
+	chunkSizeString string
+	maxAttempts     int
+	retryBaseDelay  time.Duration
+	retryMaxDelay   time.Duration
+	retryBudget     int
+	connectTimeout  time.Duration
+	tlsTimeout      time.Duration
+	headerTimeout   time.Duration
+	idleTimeout     time.Duration
+	chunkTimeout    time.Duration
+	timeout         time.Duration
+	minSpeed        int64
+	stallTime       time.Duration
+	limitRate       string
+	limitConnRate   string
+	limitSchedule   []string
+	resume          bool
+	output          string
+	dir             string
+	overwrite       bool
+	noClobber       bool
+	autoRename      bool
+	checksumStrings []string
+	checksumFile    string
+	pieceManifest   string
+	keepOnMismatch  bool
+	ignoreDigests   bool
+	restartChanged  bool
+	mirrorStrings   []string
+	hostConnections int
+	hostLimitArgs   []string
+	mirrorFile      string
+	inputFile       string
+	concurrentFiles int
+	quiet           bool
+	showConnections bool
+	outputFormat    string
+	resource        *url.URL
+	metalinkSource  string
+	mirrors         []*url.URL
+	chunkSize       int64
+	autoChunkSize   bool
+	rateLimit       int64
+	connRateLimit   int64
+	rateSchedule    []download.RateWindow
+	hostLimits      []download.HostLimit
+	clobber         download.ClobberPolicy
+	checksums       []download.Checksum
 
 	rootCmd = &cobra.Command{
-		Use:     "downloader <URL>",
-		Example: "downloader http://www.google.com -c 4",
+		Use:     "downloader <URL | metalink>",
+		Example: "downloader http://www.google.com -c 4\ndownloader ubuntu.iso.meta4 -c 8\ndownloader -i urls.txt -j 3 -c 4",
 		Short:   "A concurrent downloader written in Go.",
-		Args: func(cmd *cobra.Command, args []string) error {
+		Args: usage(func(cmd *cobra.Command, args []string) error {
+			resource, metalinkSource = nil, ""
+			if inputFile != "" {
+				if len(args) > 0 {
+					return errors.New("URLs come from the input file, none can be given with --input-file")
+				}
+				return nil
+			}
 			if len(args) < 1 {
 				return errors.New("URL required")
 			}
 			if len(args) > 1 {
 				return errors.New("too many positional arguments")
 			}
+			// A Metalink file, local or remote, describes the downloads itself
+			if metalink.IsMetalink(args[0]) {
+				metalinkSource = args[0]
+				return nil
+			}
 			// Extract, validate, and set URLString
-			_, err := url.ParseRequestURI(args[0])
-			if err != nil {
+			var err error
+			resource, err = download.ParseURL(args[0])
+			return err
+		}),
+		PreRunE: usage(func(cmd *cobra.Command, args []string) error {
+			if err := validateClientFlags(); err != nil {
 				return err
 			}
-			resource, err = url.Parse(args[0])
-			if err != nil {
-				return err
-			} else if (resource.Scheme != "http" && resource.Scheme != "https") || resource.Host == "" {
-				return errors.New("invalid URLString string, should be [http|https]://<host>[/path/to/resource]")
+			// Validate mirrors
+			mirrorURLs := mirrorStrings
+			if mirrorFile != "" {
+				fileURLs, err := readMirrorFile(mirrorFile)
+				if err != nil {
+					return err
+				}
+				mirrorURLs = append(mirrorURLs[:len(mirrorURLs):len(mirrorURLs)], fileURLs...)
 			}
-			return nil
-		},
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			// Validate nThreads
-			if nThreads < 1 {
-				return errors.New("nThreads less than 1")
+			mirrors = nil
+			for _, mirrorURL := range mirrorURLs {
+				mirror, err := download.ParseURL(mirrorURL)
+				if err != nil {
+					return fmt.Errorf("invalid mirror %s: %w", mirrorURL, err)
+				}
+				mirrors = append(mirrors, mirror)
+			}
+			// Validate output options
+			if output == download.Stdout && resume {
+				return errors.New("cannot resume a download written to stdout")
+			}
+			if outputFormat != outputText && outputFormat != outputJSON {
+				return fmt.Errorf("invalid output format %q, should be %s or %s", outputFormat, outputText, outputJSON)
+			}
+			if outputFormat == outputJSON && output == download.Stdout {
+				return errors.New("cannot print JSON to stdout while the download is written to it")
+			}
+			// Validate batch options
+			if inputFile != "" && (output != "" || len(mirrors) > 0 || len(checksumStrings) > 0 || pieceManifest != "") {
+				return errors.New("--output, --mirror, --checksum and --piece-manifest describe a single file, use out=, mirror= and checksum= in the input file instead")
+			}
+			// Validate checksums
+			checksums = nil
+			for _, checksumString := range checksumStrings {
+				checksum, err := download.ParseChecksum(checksumString)
+				if err != nil {
+					return err
+				}
+				checksums = append(checksums, checksum)
 			}
 			return nil
-		},
+		}),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			download.Downloader(nThreads, resource, chunkSize, maxAttempts)
+			// Past validation, failures are not for the usage to explain
+			cmd.SilenceUsage = true
+			// Interrupting the process cancels the download, leaving its saved state behind
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			client := newClient(cmd)
+			// JSON takes stdout over, human text goes to stderr instead
+			var jsonOut *jsonPrinter
+			summaryOut := os.Stdout
+			if outputFormat == outputJSON {
+				jsonOut, summaryOut = newJSONPrinter(os.Stdout), os.Stderr
+			}
+			reqs := []download.Request{{
+				URL:       resource,
+				Mirrors:   mirrors,
+				Output:    output,
+				Dir:       dir,
+				Checksums: checksums,
+			}}
+			if metalinkSource != "" {
+				var err error
+				if reqs, err = metalinkRequests(ctx, client, metalinkSource); err != nil {
+					return err
+				}
+			}
+			if inputFile != "" {
+				var err error
+				if reqs, err = readInputFile(inputFile); err != nil {
+					return err
+				}
+				// The progress of the downloads running at once is shown as a single line of their totals
+				var progress *batchProgress
+				if !quiet {
+					progress = newBatchProgress(summaryOut, reqs)
+				}
+				for i := range reqs {
+					setRequestOptions(&reqs[i])
+					if progress != nil {
+						reqs[i].Events = progress.subscriber(i)
+					}
+					if jsonOut != nil {
+						reqs[i].Events = jsonOut.subscriber(reqs[i], reqs[i].Events)
+					}
+				}
+				results := client.DownloadBatch(ctx, reqs, concurrentFiles)
+				failed := printBatchSummary(summaryOut, results)
+				if failed > 0 {
+					return fmt.Errorf("%d of %d downloads failed", failed, len(results))
+				}
+				return nil
+			}
+			if pieceManifest != "" {
+				if len(reqs) > 1 {
+					return fmt.Errorf("metalink describes %d files, --piece-manifest cannot be used with it", len(reqs))
+				}
+				manifest, err := client.LoadPieceManifest(ctx, pieceManifest)
+				if err != nil {
+					return err
+				}
+				reqs[0].Pieces = manifest.Pieces
+				if reqs[0].Size == 0 {
+					reqs[0].Size = manifest.Size
+				}
+				reqs[0].Checksums = append(reqs[0].Checksums, manifest.Checksums...)
+			}
+			for _, req := range reqs {
+				setRequestOptions(&req)
+				// Messages go to stderr when stdout carries the download itself
+				msgs := summaryOut
+				if req.Output == download.Stdout {
+					msgs = os.Stderr
+				}
+				if !quiet {
+					req.Events = newProgressPrinter(msgs, showConnections).print
+				}
+				if jsonOut != nil {
+					req.Events = jsonOut.subscriber(req, req.Events)
+				}
+				res, err := client.Download(ctx, req)
+				if errors.Is(err, context.Canceled) {
+					return fmt.Errorf("download interrupted, run again with --resume to continue: %w", err)
+				}
+				if err != nil {
+					return err
+				}
+				if quiet {
+					continue
+				}
+				if autoConcurrency {
+					fmt.Fprintf(msgs, "\nSettled on %d connections, pass -c %d instead of --auto to pin them\n", res.Connections, res.Connections)
+				}
+				if len(res.Mirrors) > 1 {
+					printMirrorStats(msgs, res.Mirrors)
+				}
+			}
 			return nil
 		},
 	}
 )
 
+// metalinkRequests reads the Metalink at source, a local path or URL fetched by client, into a download of each of its files.
+// --output, --mirror and --checksum only apply to a Metalink of a single file
+func metalinkRequests(ctx context.Context, client *download.Client, source string) ([]download.Request, error) {
+	m, err := metalink.Open(ctx, client, source)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Files) > 1 && (output != "" || len(mirrors) > 0 || len(checksums) > 0) {
+		return nil, fmt.Errorf("metalink describes %d files, --output, --mirror and --checksum cannot be used with it", len(m.Files))
+	}
+	var reqs []download.Request
+	for _, file := range m.Files {
+		req, err := file.Request(dir)
+		if err != nil {
+			return nil, err
+		}
+		if output != "" {
+			req.Output = output
+		}
+		req.Mirrors = append(req.Mirrors, mirrors...)
+		req.Checksums = append(req.Checksums, checksums...)
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// validateClientFlags validates the flags shared by every command that downloads,
+// setting the values parsed from them
+func validateClientFlags() error {
+	var err error
+	// Validate nThreads
+	if nThreads < 1 {
+		return errors.New("nThreads less than 1")
+	}
+	// Validate chunk size
+	autoChunkSize = chunkSizeString == "auto"
+	if !autoChunkSize {
+		if chunkSize, err = download.ParseSize(chunkSizeString); err != nil {
+			return err
+		}
+		if chunkSize < 1 {
+			return errors.New("chunk size less than 1 byte")
+		}
+	}
+	// Validate retry options
+	if retryBaseDelay <= 0 || retryMaxDelay < retryBaseDelay {
+		return errors.New("retry delays must be positive, with the max delay at least the base delay")
+	}
+	if retryBudget < 0 {
+		return errors.New("retry budget less than 0")
+	}
+	// Validate timeouts
+	for _, d := range []time.Duration{connectTimeout, tlsTimeout, headerTimeout, idleTimeout, chunkTimeout, timeout, stallTime} {
+		if d < 0 {
+			return errors.New("timeouts cannot be negative")
+		}
+	}
+	if minSpeed < 0 {
+		return errors.New("min speed less than 0")
+	}
+	// Validate rate limits
+	if rateLimit, err = download.ParseRate(limitRate); err != nil {
+		return err
+	}
+	if connRateLimit, err = download.ParseRate(limitConnRate); err != nil {
+		return err
+	}
+	rateSchedule = nil
+	for _, windowString := range limitSchedule {
+		window, err := download.ParseRateWindow(windowString)
+		if err != nil {
+			return err
+		}
+		rateSchedule = append(rateSchedule, window)
+	}
+	// Validate host limits
+	if hostConnections < 0 {
+		return errors.New("max connections per host less than 0")
+	}
+	hostLimits = nil
+	for _, limitString := range hostLimitArgs {
+		limit, err := download.ParseHostLimit(limitString)
+		if err != nil {
+			return err
+		}
+		hostLimits = append(hostLimits, limit)
+	}
+	// Validate the clobber policy
+	nPolicies := 0
+	clobber = download.Overwrite
+	for _, policy := range []struct {
+		set    bool
+		policy download.ClobberPolicy
+	}{{overwrite, download.Overwrite}, {noClobber, download.NoClobber}, {autoRename, download.AutoRename}} {
+		if policy.set {
+			nPolicies++
+			clobber = policy.policy
+		}
+	}
+	if nPolicies > 1 {
+		return errors.New("only one of --overwrite, --no-clobber and --auto-rename can be used")
+	}
+	// Validate the number of concurrent files
+	if concurrentFiles < 1 {
+		return errors.New("concurrent files less than 1")
+	}
+	return nil
+}
+
+// newClient builds the Client of a command from the validated flags
+func newClient(cmd *cobra.Command) *download.Client {
+	// With --auto, -c is the most connections to open
+	threads := nThreads
+	if autoConcurrency && !cmd.Flags().Changed("nThreads") {
+		threads = constants.DefaultAutoMaxThreads
+	}
+	// Connections to a host are capped across every download of the process
+	var hostLimiter *download.HostLimiter
+	if hostConnections > 0 || len(hostLimits) > 0 {
+		hostLimiter = download.NewHostLimiter(hostConnections, hostLimits)
+	}
+	return download.NewClient(download.Options{
+		NThreads:        threads,
+		AutoConcurrency: autoConcurrency,
+		ChunkSize:       chunkSize,
+		AutoChunkSize:   autoChunkSize,
+		MaxAttempts:     maxAttempts,
+		RetryBaseDelay:  retryBaseDelay,
+		RetryMaxDelay:   retryMaxDelay,
+		RetryBudget:     retryBudget,
+		RestartOnChange: restartChanged,
+
+		ConnectTimeout:        connectTimeout,
+		TLSHandshakeTimeout:   tlsTimeout,
+		ResponseHeaderTimeout: headerTimeout,
+		IdleTimeout:           idleTimeout,
+		ChunkTimeout:          chunkTimeout,
+		Timeout:               timeout,
+		MinSpeed:              minSpeed,
+		StallTime:             stallTime,
+
+		RateLimit:           rateLimit,
+		RateSchedule:        rateSchedule,
+		ConnectionRateLimit: connRateLimit,
+		HostLimiter:         hostLimiter,
+	})
+}
+
+// setRequestOptions applies the flags that hold for every download to req
+func setRequestOptions(req *download.Request) {
+	if req.Dir == "" {
+		req.Dir = dir
+	}
+	req.Clobber, req.Resume = clobber, resume
+	req.ChecksumFile, req.KeepOnMismatch, req.IgnoreServerDigests = checksumFile, keepOnMismatch, ignoreDigests
+}
+
+// readInputFile reads the downloads listed in the file at path, - for stdin
+func readInputFile(path string) ([]download.Request, error) {
+	if path == "-" {
+		return download.ParseInputFile(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return download.ParseInputFile(f)
+}
+
+// printBatchSummary prints a table of the outcome of every download of a batch,
+// returning how many failed
+func printBatchSummary(w io.Writer, results []download.BatchResult) (failed int) {
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tURL\tPATH\tSIZE\tTIME\tERROR")
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(tw, "FAILED\t%s\t%s\t\t%v\t%v\n", result.Request.URL, result.Path,
+				result.Duration.Round(time.Millisecond), result.Err)
+			continue
+		}
+		fmt.Fprintf(tw, "OK\t%s\t%s\t%s\t%v\t\n", result.Request.URL, result.Result.Path,
+			download.FormatSize(result.Result.Bytes), result.Duration.Round(time.Millisecond))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d of %d downloads succeeded\n", len(results)-failed, len(results))
+	return failed
+}
+
+// readMirrorFile reads the mirror URLs listed one per line in the file at path,
+// skipping blank lines and # comments
+func readMirrorFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var URLs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			URLs = append(URLs, line)
+		}
+	}
+	return URLs, scanner.Err()
+}
+
+// printMirrorStats prints a table of how each mirror of a download fared
+func printMirrorStats(w io.Writer, stats []download.MirrorStats) {
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MIRROR\tDOWNLOADED\tSPEED\tREQUESTS\tFAILURES\t")
+	for _, mirror := range stats {
+		status := ""
+		if mirror.Dropped {
+			status = "dropped"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s/s\t%d\t%d\t%s\n", mirror.URL, download.FormatSize(mirror.Bytes),
+			download.FormatSize(mirror.Throughput), mirror.Requests, mirror.Failures, status)
+	}
+	tw.Flush()
+}
+
 // Execute executes the root command.
+// See ExitCode for the code to exit with if it fails
 func Execute() error {
 	return rootCmd.Execute()
 }
 
 func init() {
-	rootCmd.Flags().IntVarP(&nThreads, "nThreads", "c", 1, "Number of concurrent goroutines")
-	rootCmd.Flags().Int64VarP(&chunkSize, "chunkSize", "s", constants.DefaultChunkSize, "Size of each range request")
-	rootCmd.Flags().IntVarP(&maxAttempts, "maxAttempts", "a", constants.DefaultMaxAttempts, "Max number of retries per chunk")
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError{err}
+	})
+	rootCmd.PersistentFlags().IntVarP(&nThreads, "nThreads", "c", 1, "Number of concurrent goroutines")
+	rootCmd.PersistentFlags().BoolVar(&autoConcurrency, "auto", false, fmt.Sprintf("Tune the number of connections to the throughput, up to -c or %d", constants.DefaultAutoMaxThreads))
+	rootCmd.PersistentFlags().StringVarP(&chunkSizeString, "chunkSize", "s", strconv.FormatInt(constants.DefaultChunkSize, 10), "Smallest piece a download is split into between connections, e.g. 4MiB, or auto to tune it to the connection")
+	rootCmd.PersistentFlags().IntVarP(&maxAttempts, "maxAttempts", "a", constants.DefaultMaxAttempts, "Max number of retries per chunk")
+	rootCmd.PersistentFlags().DurationVar(&retryBaseDelay, "retry-base-delay", constants.DefaultRetryBaseDelay, "Delay before retrying a failed chunk, doubled with every attempt")
+	rootCmd.PersistentFlags().DurationVar(&retryMaxDelay, "retry-max-delay", constants.DefaultRetryMaxDelay, "Max delay before retrying a failed chunk, unless the server asks for longer")
+	rootCmd.PersistentFlags().IntVar(&retryBudget, "retry-budget", 0, "Max number of retries across all chunks, 0 for no limit")
+	rootCmd.PersistentFlags().DurationVar(&connectTimeout, "connect-timeout", constants.DefaultConnectTimeout, "Timeout for establishing a connection")
+	rootCmd.PersistentFlags().DurationVar(&tlsTimeout, "tls-timeout", constants.DefaultTLSHandshakeTimeout, "Timeout for the TLS handshake")
+	rootCmd.PersistentFlags().DurationVar(&headerTimeout, "response-timeout", constants.DefaultResponseHeaderTimeout, "Timeout for receiving response headers")
+	rootCmd.PersistentFlags().DurationVar(&idleTimeout, "idle-timeout", constants.DefaultIdleTimeout, "Abandon and retry a transfer that receives no data for this long, 0 for no limit")
+	rootCmd.PersistentFlags().DurationVar(&chunkTimeout, "chunk-timeout", 0, "Abandon and retry a range request that takes longer than this, 0 for no limit")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "Fail a download that takes longer than this, 0 for no limit")
+	rootCmd.PersistentFlags().Int64Var(&minSpeed, "min-speed", 0, "Abandon and retry a transfer slower than this many bytes/s over --stall-time, 0 for no limit")
+	rootCmd.PersistentFlags().DurationVar(&stallTime, "stall-time", constants.DefaultStallTime, "Window over which --min-speed is measured")
+	rootCmd.PersistentFlags().StringVar(&limitRate, "limit-rate", "0", "Max download rate of all connections together, e.g. 5MB/s, 0 for no limit")
+	rootCmd.PersistentFlags().StringVar(&limitConnRate, "limit-rate-per-connection", "0", "Max download rate of each connection, e.g. 1MB/s, 0 for no limit")
+	rootCmd.PersistentFlags().StringArrayVar(&limitSchedule, "limit-schedule", nil, "Use a different --limit-rate between two times of day, e.g. 09:00-17:00=1MB/s or 22:00-06:00=0")
+	rootCmd.PersistentFlags().IntVar(&hostConnections, "max-connections-per-host", 0, "Max concurrent requests to any one host across all downloads, 0 for no limit")
+	rootCmd.PersistentFlags().StringArrayVar(&hostLimitArgs, "host-limit", nil, "Max concurrent requests to hosts matching a pattern, e.g. *.example.com=4, overriding --max-connections-per-host")
+	rootCmd.Flags().StringArrayVar(&mirrorStrings, "mirror", nil, "Another URL of the same resource to spread the download across, can be repeated")
+	rootCmd.Flags().StringVar(&mirrorFile, "mirror-file", "", "File listing other URLs of the same resource, one per line")
+	rootCmd.Flags().StringVarP(&inputFile, "input-file", "i", "", "Download every URL listed in this file, - for stdin, one per line with optional out=, dir=, checksum= and mirror= options")
+	rootCmd.PersistentFlags().IntVarP(&concurrentFiles, "concurrent-files", "j", 1, "Number of files downloaded at a time by --input-file or serve, each with -c connections")
+	rootCmd.Flags().BoolVarP(&resume, "resume", "r", false, "Resume an interrupted download from its saved state")
+	rootCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Print nothing but errors and the --input-file summary")
+	rootCmd.Flags().StringVar(&outputFormat, "output-format", outputText, "Print progress as text, or as newline-delimited JSON events ending with a summary of each download (json)")
+	rootCmd.Flags().BoolVar(&showConnections, "show-connections", false, "Show the range and speed of each connection below the progress on a terminal")
+	rootCmd.Flags().StringVarP(&output, "output", "o", "", "Save to this path, - for stdout (default: name from the server or URL)")
+	rootCmd.PersistentFlags().StringVarP(&dir, "dir", "d", "", "Directory to save to")
+	rootCmd.PersistentFlags().BoolVar(&overwrite, "overwrite", false, "Overwrite an existing file (default)")
+	rootCmd.PersistentFlags().BoolVar(&noClobber, "no-clobber", false, "Fail instead of overwriting an existing file")
+	rootCmd.PersistentFlags().BoolVar(&autoRename, "auto-rename", false, "Save to <name>.1, <name>.2, ... instead of overwriting an existing file")
+	rootCmd.Flags().StringArrayVar(&checksumStrings, "checksum", nil, "Verify the download against <algorithm>:<hex>, algorithm one of md5, sha1, sha256, sha512, blake2b")
+	rootCmd.Flags().StringVar(&checksumFile, "checksum-file", "", "Verify the download against its entry in a checksum file such as SHA256SUMS")
+	rootCmd.Flags().StringVar(&pieceManifest, "piece-manifest", "", "Verify each piece of the download as it arrives against a JSON or .zsync manifest, path or URL")
+	rootCmd.PersistentFlags().BoolVar(&keepOnMismatch, "keep-on-mismatch", false, "Keep a download that fails verification instead of removing it")
+	rootCmd.PersistentFlags().BoolVar(&ignoreDigests, "ignore-server-digest", false, "Do not verify the download against digests sent by the server")
+	rootCmd.PersistentFlags().BoolVar(&restartChanged, "restart-on-change", false, "Start over instead of failing when the resource changes on the server during the download")
 }
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/stephng3/DoubleUp/constants"
+	"github.com/stephng3/DoubleUp/download"
+	"github.com/stephng3/DoubleUp/server"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	// Flags
+	listenAddress  string
+	rpcSecret      string
+	allowOriginAll bool
+
+	serveCmd = &cobra.Command{
+		Use:     "serve",
+		Example: "downloader serve -j 3 -c 4\ndownloader serve --listen unix:/run/downloader.sock",
+		Short:   "Run a queue of downloads managed over a local HTTP/JSON API",
+		Long: `Run a queue of downloads managed over a local HTTP/JSON API:
+
+  POST /jobs              add a job, e.g. {"url": "https://example.com/a.iso", "dir": "isos"}
+  GET  /jobs              list every job
+  GET  /jobs/{id}         get a job and its progress
+  POST /jobs/{id}/pause   pause a job
+  POST /jobs/{id}/resume  resume a paused job
+  POST /jobs/{id}/cancel  cancel a job
+  DELETE /jobs/{id}       remove a completed, failed or cancelled job
+
+aria2 frontends can drive the queue too, over an aria2 compatible JSON-RPC interface at /jsonrpc.
+
+Up to -j jobs run at a time, sharing the connection flags. Jobs are saved inside --dir, paths outside
+it are refused. With --rpc-secret, API requests have to send "Authorization: Bearer <secret>" and
+JSON-RPC calls token:<secret>. Web pages of other origins, and requests addressed to any host but
+localhost, a loopback address or the --listen host, are refused unless --rpc-allow-origin-all
+is given, still listen on a loopback address or a Unix socket only reachable by trusted users.`,
+		Args: usage(cobra.NoArgs),
+		PreRunE: usage(func(cmd *cobra.Command, args []string) error {
+			if err := validateClientFlags(); err != nil {
+				return err
+			}
+			_, _, err := parseListenAddress(listenAddress)
+			return err
+		}),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Past validation, failures are not for the usage to explain
+			cmd.SilenceUsage = true
+			// Interrupting the process stops the running jobs, leaving their saved state behind
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			l, err := listen(listenAddress)
+			if err != nil {
+				return err
+			}
+			jobs := server.New(newClient(cmd), concurrentFiles, prepareJob)
+			jobs.Secret, jobs.AllowOriginAll = rpcSecret, allowOriginAll
+			if network, addr, _ := parseListenAddress(listenAddress); network == "tcp" {
+				jobs.Addr = addr
+			}
+			defer jobs.Close()
+			srv := &http.Server{Handler: jobs}
+			served := make(chan error, 1)
+			go func() { served <- srv.Serve(l) }()
+			fmt.Fprintf(os.Stdout, "Listening on %s\n", listenAddress)
+
+			select {
+			case err := <-served:
+				return err
+			case <-ctx.Done():
+			}
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), constants.ShutdownTimeout)
+			defer cancel()
+			return srv.Shutdown(shutdownCtx)
+		},
+	}
+)
+
+// prepareJob applies the flags to the request of a job, keeping it inside --dir
+func prepareJob(req *download.Request) {
+	req.Dir = filepath.Join(dir, req.Dir)
+	setRequestOptions(req)
+}
+
+// parseListenAddress splits an address to listen on into its network and address,
+// unix:<path> for a Unix socket, <host>:<port> for TCP
+func parseListenAddress(address string) (network string, addr string, err error) {
+	if strings.HasPrefix(address, "unix:") {
+		if addr = strings.TrimPrefix(address, "unix:"); addr == "" {
+			return "", "", errors.New("missing Unix socket path, should be unix:<path>")
+		}
+		return "unix", addr, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q, should be <host>:<port> or unix:<path>: %v", address, err)
+	}
+	return "tcp", address, nil
+}
+
+// listen listens on address, replacing a stale Unix socket left behind by an earlier run
+func listen(address string) (net.Listener, error) {
+	network, addr, err := parseListenAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", addr); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use by another daemon", addr)
+			}
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&listenAddress, "listen", constants.DefaultListenAddress, "Address to serve the API on, <host>:<port> or unix:<path>")
+	serveCmd.Flags().StringVar(&rpcSecret, "rpc-secret", "", "Secret API requests have to pass as Authorization: Bearer <secret> and JSON-RPC calls as token:<secret>, like aria2's --rpc-secret")
+	serveCmd.Flags().BoolVar(&allowOriginAll, "rpc-allow-origin-all", false, "Let web pages of any origin make API requests and JSON-RPC calls, whatever host they are addressed to")
+	rootCmd.AddCommand(serveCmd)
+}
@@ -1,6 +1,33 @@
 package constants
 
+import "time"
+
 const (
-	DefaultChunkSize   int64 = 64000 // 64kB default chunk size
-	DefaultMaxAttempts       = 5     // 5 default max retries per chunk
+	DefaultChunkSize      int64 = 64000                  // 64kB default chunk size
+	DefaultMaxAttempts          = 5                      // 5 default max retries per chunk
+	DefaultRetryBaseDelay       = 500 * time.Millisecond // Delay before the first retry of a chunk, doubled for every further one
+	DefaultRetryMaxDelay        = 30 * time.Second       // Cap on the delay between retries of a chunk
+
+	DefaultProbeSize       int64 = 256 << 10 // Bytes fetched to measure the connection when tuning the chunk size
+	MaxAutoChunkSize       int64 = 64 << 20  // Largest chunk size picked when tuning it
+	DefaultRequestOverhead       = 0.05      // Share of a request's time it may spend waiting for the first byte
+
+	MirrorMaxFailures = 3 // Failures in a row after which a mirror is dropped
+
+	DefaultAutoMaxThreads = 16          // Most connections --auto opens unless -c is given
+	DefaultAutoInterval   = time.Second // Interval over which --auto measures throughput
+
+	DefaultConnectTimeout        = 30 * time.Second // Establishing a TCP connection
+	DefaultTLSHandshakeTimeout   = 10 * time.Second // Completing a TLS handshake
+	DefaultResponseHeaderTimeout = 30 * time.Second // Waiting for response headers
+	DefaultIdleTimeout           = 60 * time.Second // Abandoning a transfer that receives nothing
+	DefaultStallTime             = 30 * time.Second // Window over which the minimum speed is measured
+
+	DefaultProgressInterval = 500 * time.Millisecond // Interval between progress events of a download
+	DefaultSpeedWindow      = 5 * time.Second        // Window over which the speed of a download is measured
+	ProgressRedrawInterval  = 100 * time.Millisecond // Min interval between redraws of the progress on a terminal
+	ProgressLogInterval     = 5 * time.Second        // Interval between progress lines when not printing to a terminal
+
+	DefaultListenAddress = "127.0.0.1:6800" // Address the serve daemon listens on
+	ShutdownTimeout      = 10 * time.Second // Time the serve daemon gives open API requests to finish
 )
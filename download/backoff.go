@@ -0,0 +1,87 @@
+package download
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// backoffDelay is how long to wait before attempt number attempt+1 of a chunk, after attempt failed.
+// The delay doubles with every attempt up to maxDelay, and is jittered to somewhere between
+// half of that and all of it so that failed chunks do not all come back at the same moment
+func backoffDelay(attempt int, baseDelay time.Duration, maxDelay time.Duration) time.Duration {
+	delay := baseDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter reads the Retry-After header of a 429 or 503 response,
+// given either as a number of seconds or as an HTTP date. Zero if there is none
+func parseRetryAfter(res *http.Response) time.Duration {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// retryGate holds back every worker of a download until the time a server asked us to wait for,
+// since a server telling one connection to slow down means it wants to hear less from all of them
+type retryGate struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// delay keeps the gate closed for at least d from now
+func (g *retryGate) delay(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until := time.Now().Add(d); until.After(g.until) {
+		g.until = until
+	}
+}
+
+// wait blocks until the gate opens or ctx is done
+func (g *retryGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	until := g.until
+	g.mu.Unlock()
+	return sleep(ctx, time.Until(until))
+}
+
+// sleep waits for d, returning early with the context's error if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+package download
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+  Tests for retry backoff
+*/
+
+func TestBackoffDelay(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+	backoffTests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, test := range backoffTests {
+		for i := 0; i < 100; i++ {
+			delay := backoffDelay(test.attempt, base, max)
+			if delay < test.ceiling/2 || delay > test.ceiling {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", test.attempt, delay, test.ceiling/2, test.ceiling)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	retryAfterTests := []struct {
+		status     int
+		retryAfter string
+		min        time.Duration
+		max        time.Duration
+	}{
+		{http.StatusServiceUnavailable, "120", 120 * time.Second, 120 * time.Second},
+		{http.StatusTooManyRequests, "3", 3 * time.Second, 3 * time.Second},
+		{http.StatusTooManyRequests, time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{http.StatusTooManyRequests, "Wed, 21 Oct 2015 07:28:00 GMT", 0, 0},
+		{http.StatusTooManyRequests, "soon", 0, 0},
+		{http.StatusInternalServerError, "120", 0, 0},
+	}
+	for _, test := range retryAfterTests {
+		res := &http.Response{StatusCode: test.status, Header: http.Header{"Retry-After": {test.retryAfter}}}
+		if delay := parseRetryAfter(res); delay < test.min || delay > test.max {
+			t.Errorf("status %d Retry-After %s: delay %v outside [%v, %v]", test.status, test.retryAfter, delay, test.min, test.max)
+		}
+	}
+}
+
+// Every worker holds off for as long as the server asked one of them to
+func TestDownloadRetryAfter(t *testing.T) {
+	downloadTest, err := ioutil.TempFile(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadTest.Close()
+	defer os.Remove(downloadTest.Name())
+	url, err := getTestURL("/busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&busyRequests, 0)
+	began := time.Now()
+	_, err = testClient.downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, newTestState(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(began); elapsed < time.Second {
+		t.Errorf("download finished after %v, before the requested Retry-After of 1s", elapsed)
+	}
+}
+
+func TestDownloadRetryBudget(t *testing.T) {
+	downloadTest, err := ioutil.TempFile(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadTest.Close()
+	defer os.Remove(downloadTest.Name())
+	url, err := getTestURL("/fail-range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	budgetOptions := testOptions
+	budgetOptions.RetryBudget = 2
+	_, err = NewClient(budgetOptions).downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, newTestState(url))
+	if err == nil || !strings.Contains(err.Error(), "retry budget of 2 exhausted") {
+		t.Errorf("expected retry budget error, got %v", err)
+	}
+}
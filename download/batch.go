@@ -0,0 +1,137 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseInputFile reads a list of downloads, one per line: a URL followed by options for it,
+// e.g. "https://example.com/a.iso out=b.iso checksum=sha256:e3b0c442...". The options are
+// out (Output), dir (Dir), checksum and mirror, the last two repeatable.
+// Blank lines and lines starting with # are skipped
+func ParseInputFile(r io.Reader) ([]Request, error) {
+	var reqs []Request
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		req, err := parseInputLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("input line %d: %w", n, err)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, scanner.Err()
+}
+
+func parseInputLine(fields []string) (req Request, err error) {
+	if req.URL, err = ParseURL(fields[0]); err != nil {
+		return req, err
+	}
+	for _, option := range fields[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return req, fmt.Errorf("invalid option %q, should be <name>=<value>", option)
+		}
+		switch kv[0] {
+		case "out":
+			req.Output = kv[1]
+		case "dir":
+			req.Dir = kv[1]
+		case "checksum":
+			checksum, err := ParseChecksum(kv[1])
+			if err != nil {
+				return req, err
+			}
+			req.Checksums = append(req.Checksums, checksum)
+		case "mirror":
+			mirror, err := ParseURL(kv[1])
+			if err != nil {
+				return req, fmt.Errorf("invalid mirror %s: %w", kv[1], err)
+			}
+			req.Mirrors = append(req.Mirrors, mirror)
+		default:
+			return req, fmt.Errorf("unknown option %q, should be one of out, dir, checksum or mirror", kv[0])
+		}
+	}
+	return req, nil
+}
+
+// ParseURL parses the absolute http(s) URL of a resource to download
+func ParseURL(s string) (*url.URL, error) {
+	if _, err := url.ParseRequestURI(s); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, &url.Error{Op: "parse", URL: s, Err: errors.New("invalid URLString string, should be [http|https]://<host>[/path/to/resource]")}
+	}
+	return u, nil
+}
+
+// BatchResult is the outcome of one download of a batch
+type BatchResult struct {
+	Request Request
+	Result  *Result // nil if the download failed
+	// Path is where the download was saved, or was being saved when it failed.
+	// A download failing before it picked one has the path going by its Output or URL
+	Path     string
+	Err      error
+	Duration time.Duration
+}
+
+// DownloadBatch downloads every one of reqs, up to files of them at a time, over the Client's
+// shared connections. A failed download does not stop the others, the results are in the order of reqs.
+// Downloads resolving to the same path at the same time are renamed under AutoRename, and otherwise fail
+func (c *Client) DownloadBatch(ctx context.Context, reqs []Request, files int) []BatchResult {
+	if files < 1 {
+		files = 1
+	}
+	results := make([]BatchResult, len(reqs))
+	slots := make(chan struct{}, files)
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			// Downloads not started yet fail with the reason for stopping
+			for ; i < len(reqs); i++ {
+				results[i] = BatchResult{Request: reqs[i], Path: outputPath(reqs[i], Capabilities{}), Err: ctx.Err()}
+			}
+			wg.Wait()
+			return results
+		}
+		wg.Add(1)
+		go func(i int, req Request) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			began := time.Now()
+			path := outputPath(req, Capabilities{})
+			watched := req
+			watched.Events = func(e Event) {
+				if e.Type == EventStarted {
+					path = e.Path
+				}
+				if req.Events != nil {
+					req.Events(e)
+				}
+			}
+			res, err := c.Download(ctx, watched)
+			results[i] = BatchResult{Request: req, Result: res, Path: path, Err: err, Duration: time.Since(began)}
+		}(i, req)
+	}
+	wg.Wait()
+	return results
+}
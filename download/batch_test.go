@@ -0,0 +1,124 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseInputFile(t *testing.T) {
+	reqs, err := ParseInputFile(strings.NewReader(`# Nightly artifacts
+http://example.com/a.iso out=b.iso dir=isos checksum=md5:d41d8cd98f00b204e9800998ecf8427e mirror=http://mirror.example.com/a.iso
+
+  https://example.com/c.tar.gz
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 downloads, got %d", len(reqs))
+	}
+	if reqs[0].Output != "b.iso" || reqs[0].Dir != "isos" || len(reqs[0].Checksums) != 1 || len(reqs[0].Mirrors) != 1 {
+		t.Errorf("options not parsed, got %+v", reqs[0])
+	}
+	if reqs[1].URL.String() != "https://example.com/c.tar.gz" {
+		t.Errorf("unexpected URL %s", reqs[1].URL)
+	}
+
+	for _, line := range []string{
+		"ftp://example.com/a.iso",
+		"http://example.com/a.iso out",
+		"http://example.com/a.iso name=b.iso",
+		"http://example.com/a.iso checksum=md5:00",
+	} {
+		if _, err := ParseInputFile(strings.NewReader(line)); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("expected %q to be rejected, got %v", line, err)
+		}
+	}
+}
+
+// Every download of a batch is attempted, and a failure leaves the others alone
+func TestDownloadBatch(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reqs, err := ParseInputFile(strings.NewReader(
+		getTestEndpoint("/success") + " out=a\n" +
+			getTestEndpoint("/missing") + "\n" +
+			getTestEndpoint("/attachment") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range reqs {
+		reqs[i].Dir = dir
+	}
+	results := testClient.DownloadBatch(context.Background(), reqs, 2)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for i, expected := range []struct {
+		path string
+		ok   bool
+	}{{"a", true}, {"missing", false}, {AttachmentName, true}} {
+		result := results[i]
+		if (result.Err == nil) != expected.ok {
+			t.Errorf("download %d: unexpected error %v", i, result.Err)
+			continue
+		}
+		if result.Err == nil && result.Result.Path != filepath.Join(dir, expected.path) {
+			t.Errorf("download %d: expected %s, got %s", i, expected.path, result.Result.Path)
+		}
+		// Failed downloads are reported by the name they would have had
+		if result.Path != filepath.Join(dir, expected.path) {
+			t.Errorf("download %d: expected the result path %s, got %s", i, expected.path, result.Path)
+		}
+	}
+
+	// Downloads not started before cancellation fail with it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, result := range testClient.DownloadBatch(ctx, reqs, 1) {
+		if result.Err == nil {
+			t.Error("expected a cancelled batch to fail")
+		}
+	}
+}
+
+// Downloads of a batch resolving to the same path never write into one file
+func TestDownloadBatchSamePath(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reqs, err := ParseInputFile(strings.NewReader(strings.Repeat(getTestEndpoint("/slow")+" out=a\n", 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range reqs {
+		reqs[i].Dir, reqs[i].Clobber = dir, AutoRename
+	}
+	results := testClient.DownloadBatch(context.Background(), reqs, 3)
+	paths := map[string]bool{}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Fatalf("download %d: %v", i, result.Err)
+		}
+		paths[result.Result.Path] = true
+	}
+	if len(paths) != 3 {
+		t.Errorf("expected every download saved to its own path, got %v", paths)
+	}
+
+	reqs[0].Clobber, reqs[1].Clobber = Overwrite, Overwrite
+	results = testClient.DownloadBatch(context.Background(), reqs[:2], 2)
+	if (results[0].Err == nil) == (results[1].Err == nil) || !strings.Contains(fmt.Sprint(results[0].Err, results[1].Err), "being written by another download") {
+		t.Errorf("expected one of two downloads overwriting the same path to fail, got %v and %v", results[0].Err, results[1].Err)
+	}
+}
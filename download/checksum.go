@@ -0,0 +1,216 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Checksum is the expected digest of a whole download
+type Checksum struct {
+	Algorithm string // One of md5, sha1, sha256, sha512, blake2b (BLAKE2b-512) or crc32c
+	Sum       []byte
+	Source    string // Where the checksum came from, e.g. the header a server sent it in
+}
+
+func (c Checksum) String() string {
+	return c.Algorithm + ":" + hex.EncodeToString(c.Sum)
+}
+
+// newHash returns a hash computing the given algorithm
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake2b":
+		return blake2b.New512(nil)
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
+
+// ParseChecksum parses a checksum in <algorithm>:<hex> form, e.g. sha256:e3b0c442...
+func ParseChecksum(s string) (Checksum, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return Checksum{}, fmt.Errorf("invalid checksum %q, should be <algorithm>:<hex>", s)
+	}
+	return newChecksum(strings.ToLower(parts[0]), parts[1])
+}
+
+// newChecksum builds a Checksum from a hex digest, checking it has the right length for algorithm
+func newChecksum(algorithm string, hexSum string) (Checksum, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return Checksum{}, err
+	}
+	sum, err := hex.DecodeString(hexSum)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("invalid %s checksum %q: %v", algorithm, hexSum, err)
+	}
+	if len(sum) != h.Size() {
+		return Checksum{}, fmt.Errorf("invalid %s checksum %q: expected %d hex digits", algorithm, hexSum, 2*h.Size())
+	}
+	return Checksum{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// Checksum file names as written by the usual tools, and the algorithm they contain
+var checksumFileAlgorithms = []struct {
+	prefix    string
+	algorithm string
+}{
+	{"md5", "md5"},
+	{"sha1", "sha1"},
+	{"sha256", "sha256"},
+	{"sha512", "sha512"},
+	{"b2", "blake2b"},
+	{"blake2", "blake2b"},
+}
+
+// algorithmForFile guesses the algorithm used in a checksum file from its name (e.g. SHA256SUMS)
+// and failing that, from the length of the hex digest
+func algorithmForFile(path string, hexSum string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for _, known := range checksumFileAlgorithms {
+		if strings.HasPrefix(name, known.prefix) {
+			return known.algorithm
+		}
+	}
+	switch len(hexSum) {
+	case 2 * md5.Size:
+		return "md5"
+	case 2 * sha1.Size:
+		return "sha1"
+	case 2 * sha256.Size:
+		return "sha256"
+	default:
+		return "sha512"
+	}
+}
+
+// LookupChecksum finds the checksum of filename in a checksum file at path.
+// Both the GNU coreutils format (<hex>  <name>) and the BSD tagged format
+// (SHA256 (<name>) = <hex>) are understood
+func LookupChecksum(path string, filename string) (Checksum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Checksum{}, err
+	}
+	defer f.Close()
+	return lookupChecksum(f, path, filename)
+}
+
+// bsdChecksumLine is a line of the BSD tagged format, matching its algorithm, name and hex digest
+var bsdChecksumLine = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.*)\) = ([0-9A-Fa-f]+)$`)
+
+func lookupChecksum(r io.Reader, path string, filename string) (Checksum, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// BSD style: ALGO (name) = hex
+		if match := bsdChecksumLine.FindStringSubmatch(line); match != nil {
+			if match[2] == filename {
+				algorithm := strings.ToLower(strings.Replace(match[1], "-", "", -1))
+				if algorithm == "blake2b512" {
+					algorithm = "blake2b"
+				}
+				return checksumFromFile(algorithm, match[3], path)
+			}
+			continue
+		}
+		// GNU style: hex, a space, then a space (text) or * (binary) and the name
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(fields[1], " "), "*")
+		if name == filename || filepath.Base(name) == filename {
+			return checksumFromFile(algorithmForFile(path, fields[0]), fields[0], path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Checksum{}, err
+	}
+	return Checksum{}, fmt.Errorf("no checksum for %s in %s", filename, path)
+}
+
+// checksumFromFile builds a Checksum found in the checksum file at path
+func checksumFromFile(algorithm string, hexSum string, path string) (Checksum, error) {
+	checksum, err := newChecksum(algorithm, hexSum)
+	checksum.Source = filepath.Base(path)
+	return checksum, err
+}
+
+// verifyReader hashes everything in r once and compares it to every expected checksum.
+// path is only used to describe a mismatch
+func verifyReader(r io.Reader, path string, expected []Checksum) error {
+	hashes := make([]hash.Hash, len(expected))
+	writers := make([]io.Writer, len(expected))
+	for i, checksum := range expected {
+		h, err := newHash(checksum.Algorithm)
+		if err != nil {
+			return err
+		}
+		hashes[i], writers[i] = h, h
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return err
+	}
+	for i, checksum := range expected {
+		if err := compareChecksum(hashes[i], path, checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareChecksum checks the digest accumulated in h
+func compareChecksum(h hash.Hash, path string, expected Checksum) error {
+	if actual := h.Sum(nil); !bytes.Equal(actual, expected.Sum) {
+		return &ChecksumError{
+			Path:      path,
+			Algorithm: expected.Algorithm,
+			Source:    expected.Source,
+			Expected:  expected.Sum,
+			Actual:    actual,
+		}
+	}
+	return nil
+}
+
+// verifyFile checks the file at path against every expected checksum, reading it once
+func verifyFile(path string, expected []Checksum) error {
+	if len(expected) == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifyReader(f, path, expected)
+}
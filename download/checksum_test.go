@@ -0,0 +1,153 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+  Tests for checksum verification
+*/
+
+func TestParseChecksum(t *testing.T) {
+	checksumTests := []struct {
+		in    string
+		error string
+	}{
+		{"sha256:" + strings.Repeat("ab", sha256.Size), ""},
+		{"SHA256:" + strings.Repeat("AB", sha256.Size), ""},
+		{"md5:" + strings.Repeat("00", 16), ""},
+		{"sha1:" + strings.Repeat("00", 20), ""},
+		{"sha512:" + strings.Repeat("00", 64), ""},
+		{"blake2b:" + strings.Repeat("00", 64), ""},
+		{strings.Repeat("ab", sha256.Size), "should be <algorithm>:<hex>"},
+		{"crc32:00000000", "unsupported checksum algorithm"},
+		{"sha256:xyz", "invalid sha256 checksum"},
+		{"sha256:abcd", "expected 64 hex digits"},
+	}
+	for _, test := range checksumTests {
+		_, err := ParseChecksum(test.in)
+		if (err == nil) != (test.error == "") || (err != nil && !strings.Contains(err.Error(), test.error)) {
+			t.Errorf("parsing %s: expected error %q, got %v", test.in, test.error, err)
+		}
+	}
+}
+
+func TestLookupChecksum(t *testing.T) {
+	sum := strings.Repeat("ab", sha256.Size)
+	other := strings.Repeat("cd", sha256.Size)
+	lookupTests := []struct {
+		path     string
+		contents string
+		filename string
+		expected string
+	}{
+		{"SHA256SUMS", other + "  other.tar.gz\n" + sum + "  release.tar.gz\n", "release.tar.gz", "sha256:" + sum},
+		{"SHA256SUMS", sum + " *release.tar.gz\n", "release.tar.gz", "sha256:" + sum},
+		{"SHA256SUMS", sum + "  dist/release.tar.gz\n", "release.tar.gz", "sha256:" + sum},
+		{"checksums.txt", "SHA256 (other.tar.gz) = " + other + "\nSHA256 (release.tar.gz) = " + sum + "\n", "release.tar.gz", "sha256:" + sum},
+		{"checksums.txt", strings.Repeat("ab", 16) + "  release.tar.gz\n", "release.tar.gz", "md5:" + strings.Repeat("ab", 16)},
+		{"B2SUMS", strings.Repeat("ab", 64) + "  release.tar.gz\n", "release.tar.gz", "blake2b:" + strings.Repeat("ab", 64)},
+		{"SHA256SUMS", other + "  x) = y (z\n" + sum + "  release.tar.gz\n", "release.tar.gz", "sha256:" + sum},
+		{"checksums.txt", "SHA256 (release (1).tar.gz) = " + sum + "\n", "release (1).tar.gz", "sha256:" + sum},
+	}
+	for _, test := range lookupTests {
+		checksum, err := lookupChecksum(strings.NewReader(test.contents), test.path, test.filename)
+		if err != nil {
+			t.Errorf("looking up %s in %s: %v", test.filename, test.path, err)
+		} else if checksum.String() != test.expected {
+			t.Errorf("looking up %s in %s: expected %s, got %s", test.filename, test.path, test.expected, checksum)
+		}
+	}
+	_, err := lookupChecksum(strings.NewReader(sum+"  other.tar.gz\n"), "SHA256SUMS", "release.tar.gz")
+	if err == nil || !strings.Contains(err.Error(), "no checksum for release.tar.gz") {
+		t.Errorf("expected missing entry error, got %v", err)
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := testFileChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := Checksum{Algorithm: "sha256", Sum: make([]byte, sha256.Size)}
+
+	// Matching checksum, given directly and through a checksum file
+	sumsPath := filepath.Join(dir, "SHA256SUMS")
+	if err := ioutil.WriteFile(sumsPath, []byte(hex.EncodeToString(good.Sum)+"  success\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := testClient.Download(context.Background(), Request{URL: url, Dir: dir, Checksums: []Checksum{good}, ChecksumFile: sumsPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Checksums) != 2 {
+		t.Errorf("expected 2 checksums verified, got %d", len(res.Checksums))
+	}
+
+	// Mismatch removes the download unless asked to keep it
+	for _, keep := range []bool{false, true} {
+		_, err = testClient.Download(context.Background(), Request{URL: url, Dir: dir, Checksums: []Checksum{bad}, KeepOnMismatch: keep})
+		var checksumErr *ChecksumError
+		if !errors.Is(err, ErrChecksumMismatch) || !errors.As(err, &checksumErr) {
+			t.Fatalf("expected checksum mismatch, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "success")); os.IsNotExist(err) == keep {
+			t.Errorf("keep on mismatch %v, but file exists is %v", keep, !os.IsNotExist(err))
+		}
+	}
+}
+
+// Checksum of the test file served by the test server
+func testFileChecksum() (Checksum, error) {
+	f, err := os.Open(testFileName)
+	if err != nil {
+		return Checksum{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return Checksum{}, err
+	}
+	return Checksum{Algorithm: "sha256", Sum: h.Sum(nil)}, nil
+}
+
+// Every checksum of a file is verified in a single pass over it
+func TestVerifyFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	md5Sum, _ := ParseChecksum("md5:b1946ac92492d2347c6235b4d2611184")
+	sha256Sum, _ := ParseChecksum("sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")
+	if err := verifyFile(path, []Checksum{md5Sum, sha256Sum}); err != nil {
+		t.Error(err)
+	}
+	sha256Sum.Sum[0] ^= 0xff
+	var checksumErr *ChecksumError
+	if err := verifyFile(path, []Checksum{md5Sum, sha256Sum}); !errors.As(err, &checksumErr) || checksumErr.Algorithm != "sha256" {
+		t.Errorf("expected a sha256 mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"github.com/stephng3/DoubleUp/constants"
+	"io"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+)
+
+// optimalChunkSize is the smallest chunk whose request spends no more than overhead of its time
+// waiting for the first byte, on a connection with the given latency and throughput in bytes/s.
+// A chunk takes latency + size/throughput, so that is size >= throughput*latency*(1-overhead)/overhead.
+// The size is kept within [minSize, maxSize] and rounded up to a multiple of 4KiB
+func optimalChunkSize(latency time.Duration, throughput float64, overhead float64, minSize int64, maxSize int64) int64 {
+	size := int64(throughput * latency.Seconds() * (1 - overhead) / overhead)
+	size = (size + 4095) / 4096 * 4096
+	if size > maxSize {
+		size = maxSize
+	}
+	if size < minSize {
+		size = minSize
+	}
+	return size
+}
+
+// tuneChunkSize picks the chunk size of a parallel download by fetching its first bytes to w,
+// timing how long the response takes to start (latency) and how fast it arrives after (throughput).
+// Chunks are made large enough to keep the share of time spent waiting on requests under
+// RequestOverhead, but small enough to give every connection a span.
+// It returns the chunk size and how many bytes were fetched, falling back to ChunkSize if the probe fails
+func (c *Client) tuneChunkSize(ctx context.Context, r *reporter, caps Capabilities, URL *url.URL, w io.WriterAt) (chunkSize int64, probed int64, err error) {
+	probeSize := constants.DefaultProbeSize
+	if probeSize > caps.Length {
+		probeSize = caps.Length
+	}
+	var firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	chunk := Chunk{
+		OffsetWriter: OffsetWriter{WriterAt: w},
+		URL:          URL,
+		chunkType:    caps.ChunkType,
+		end:          probeSize,
+		total:        caps.Length,
+		etag:         caps.ETag,
+		lastModified: caps.LastModified,
+	}
+	began := time.Now()
+	err = c.downloadChunk(httptrace.WithClientTrace(ctx, trace), chunk)
+	done := time.Now()
+	if errors.Is(err, ErrRangeUnsupported) || errors.Is(err, ErrResourceChanged) || ctx.Err() != nil {
+		return c.ChunkSize, 0, err
+	}
+	if err != nil || firstByte.IsZero() {
+		r.noticef("Could not measure the connection to tune the chunk size, using %s: %v", FormatSize(c.ChunkSize), err)
+		return c.ChunkSize, 0, nil
+	}
+
+	latency := firstByte.Sub(began)
+	transfer := done.Sub(firstByte)
+	if transfer <= 0 {
+		transfer = time.Microsecond
+	}
+	throughput := float64(probeSize) / transfer.Seconds()
+	maxSize := caps.Length / int64(c.NThreads)
+	if maxSize > constants.MaxAutoChunkSize {
+		maxSize = constants.MaxAutoChunkSize
+	}
+	chunkSize = optimalChunkSize(latency, throughput, c.RequestOverhead, constants.DefaultChunkSize, maxSize)
+	return chunkSize, probeSize, nil
+}
@@ -0,0 +1,72 @@
+package download
+
+import (
+	"context"
+	"github.com/stephng3/DoubleUp/constants"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOptimalChunkSize(t *testing.T) {
+	chunkSizeTests := []struct {
+		latency    time.Duration
+		throughput float64
+		size       int64
+	}{
+		// 10MB/s with 50ms to the first byte needs 9.5MB chunks to keep waiting under 5%
+		{50 * time.Millisecond, 10e6, 9502720},
+		{time.Millisecond, 1e6, constants.DefaultChunkSize},
+		{time.Second, 100e6, constants.MaxAutoChunkSize},
+	}
+	for _, test := range chunkSizeTests {
+		size := optimalChunkSize(test.latency, test.throughput, 0.05, constants.DefaultChunkSize, constants.MaxAutoChunkSize)
+		if size != test.size {
+			t.Errorf("%v at %.0fB/s: expected %d, got %d", test.latency, test.throughput, test.size, size)
+		}
+	}
+}
+
+// The bytes fetched to tune the chunk size are kept, and the rest of the download completes them
+func TestDownloadAutoChunkSize(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.AutoChunkSize = true
+	res, err := NewClient(opts).Download(context.Background(), Request{URL: url, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloadedFile(t, res.Path)
+}
+
+// Without a length there is nothing to split, the download takes a single stream instead of tuning chunks
+func TestDownloadAutoChunkSizeUnknownLength(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/unknown-length")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.AutoChunkSize = true
+	res, err := NewClient(opts).Download(context.Background(), Request{URL: url, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Connections != 1 || res.Capabilities.CanRange {
+		t.Errorf("expected a single stream, got %+v", res)
+	}
+	checkDownloadedFile(t, res.Path)
+}
@@ -0,0 +1,224 @@
+package download
+
+import (
+	"context"
+	"github.com/stephng3/DoubleUp/constants"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Options configure a Client
+// Zero values are replaced by the defaults in the constants package
+type Options struct {
+	NThreads    int   // Number of concurrent range requests, the most there can be with AutoConcurrency
+	ChunkSize   int64 // Smallest piece a download is split into between connections
+	MaxAttempts int   // Max number of attempts per chunk
+
+	// AutoChunkSize replaces ChunkSize for fresh parallel downloads with one tuned to the latency
+	// and throughput of the connection, so that requests spend no more than RequestOverhead
+	// of their time waiting for the first byte
+	AutoChunkSize   bool
+	RequestOverhead float64
+
+	// Failed chunks are retried after a delay starting at RetryBaseDelay, doubling with every
+	// attempt up to RetryMaxDelay, or longer if the server asks for it with Retry-After
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	// RetryBudget caps the number of retries across all chunks of a download, 0 for no cap
+	RetryBudget int
+
+	// AutoConcurrency starts parallel downloads on a single connection and tunes the number of
+	// connections as it goes, adding them while throughput grows and backing off on errors.
+	// The throughput is measured over every AutoInterval
+	AutoConcurrency bool
+	AutoInterval    time.Duration
+
+	// RestartOnChange starts a download over when the resource changes on the server
+	// part way through it, instead of failing with ErrResourceChanged
+	RestartOnChange bool
+
+	// Timeouts of the connections made by the Client, ignored if HTTPClient is set
+	ConnectTimeout        time.Duration // Establishing a TCP connection
+	TLSHandshakeTimeout   time.Duration // Completing a TLS handshake
+	ResponseHeaderTimeout time.Duration // Waiting for response headers once a request is sent
+	// Timeouts of transfers, 0 for none
+	IdleTimeout  time.Duration // Abandon a transfer that receives no data for this long
+	ChunkTimeout time.Duration // Abandon a range request that takes longer than this in total
+	Timeout      time.Duration // Fail a whole download that takes longer than this
+	// Abandon a transfer that receives fewer than MinSpeed bytes a second over StallTime
+	MinSpeed  int64
+	StallTime time.Duration
+
+	// RateLimit caps the bytes a second downloaded by every transfer of the Client together,
+	// RateSchedule overrides it at certain times of day. ConnectionRateLimit caps each transfer on its own.
+	// 0 for no limit
+	RateLimit           int64
+	RateSchedule        []RateWindow
+	ConnectionRateLimit int64
+
+	// HTTPClient is used for every request made by the Client if set
+	HTTPClient *http.Client
+	// HostLimiter caps the requests in flight to each host, across every Client sharing it. nil for no limit
+	HostLimiter *HostLimiter
+}
+
+// Client downloads resources with the configured Options
+// A Client holds no per-download state and can be used for several downloads at once,
+// which share its RateLimit
+type Client struct {
+	Options
+	http    *http.Client
+	limiter *rateLimiter // Shared by every transfer to enforce RateLimit
+	outputs *outputs     // Paths being downloaded to
+}
+
+// NewClient returns a Client using opts, with defaults filled in
+func NewClient(opts Options) *Client {
+	if opts.NThreads < 1 {
+		opts.NThreads = 1
+	}
+	if opts.ChunkSize < 1 {
+		opts.ChunkSize = constants.DefaultChunkSize
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = constants.DefaultMaxAttempts
+	}
+	if opts.RetryBaseDelay <= 0 {
+		opts.RetryBaseDelay = constants.DefaultRetryBaseDelay
+	}
+	if opts.RetryMaxDelay <= 0 {
+		opts.RetryMaxDelay = constants.DefaultRetryMaxDelay
+	}
+	if opts.RequestOverhead <= 0 || opts.RequestOverhead >= 1 {
+		opts.RequestOverhead = constants.DefaultRequestOverhead
+	}
+	if opts.AutoInterval <= 0 {
+		opts.AutoInterval = constants.DefaultAutoInterval
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = constants.DefaultConnectTimeout
+	}
+	if opts.TLSHandshakeTimeout <= 0 {
+		opts.TLSHandshakeTimeout = constants.DefaultTLSHandshakeTimeout
+	}
+	if opts.ResponseHeaderTimeout <= 0 {
+		opts.ResponseHeaderTimeout = constants.DefaultResponseHeaderTimeout
+	}
+	if opts.StallTime <= 0 {
+		opts.StallTime = constants.DefaultStallTime
+	}
+	c := &Client{Options: opts, http: opts.HTTPClient, limiter: newRateLimiter(opts.RateLimit, opts.RateSchedule), outputs: &outputs{paths: map[string]interface{}{}}}
+	if c.http == nil {
+		c.http = newHTTPClient(opts)
+	}
+	return c
+}
+
+// Open reads a local path or an http(s) URL, fetching the URL with the connection settings of the Client.
+// The URL's host connection is held until the returned reader is closed
+func (c *Client) Open(ctx context.Context, source string) (io.ReadCloser, error) {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return os.Open(source)
+	}
+	release, err := c.acquireHost(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		release()
+		return nil, &StatusError{Code: res.StatusCode, Status: res.Status}
+	}
+	return &releasingBody{ReadCloser: res.Body, release: release}, nil
+}
+
+// releasingBody is a response body that frees its host connection once closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// newHTTPClient builds the http client of a Client, which reuses connections across requests
+// See https://golang.org/pkg/net/http/#pkg-overview
+func newHTTPClient(opts Options) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	// Keep a connection around for every worker between chunks
+	transport.MaxIdleConnsPerHost = opts.NThreads
+	return &http.Client{Transport: transport}
+}
+
+// Request describes a single download
+type Request struct {
+	URL *url.URL
+	// Mirrors are other URLs of the same resource, which a parallel download is spread across
+	Mirrors []*url.URL
+	// Output is where the resource is saved, Stdout to stream it to standard output.
+	// If empty, the name is taken from the Content-Disposition header or the URL path
+	Output  string
+	Dir     string        // Directory a relative Output is saved in
+	Clobber ClobberPolicy // What to do when Output already exists
+	Resume  bool          // Pick up progress saved by an earlier parallel download of Output
+
+	// Size the resource is expected to have, 0 if not known
+	Size int64
+	// Checksums the completed download must match
+	Checksums []Checksum
+	// Pieces are checksums of parts of the resource, each verified and if need be fetched again as it is downloaded
+	Pieces *Pieces
+	// ChecksumFile is a SHA256SUMS style file in which the expected checksum is looked up by output filename
+	ChecksumFile string
+	// IgnoreServerDigests skips verifying against digests the server sent (Digest, Repr-Digest, Content-MD5, ...)
+	IgnoreServerDigests bool
+	// KeepOnMismatch leaves a download that fails verification in place instead of removing it
+	KeepOnMismatch bool
+
+	// Events, if set, is called with every Event of the download as it goes, one at a time.
+	// It must not block, to send them on to a channel use a buffered one or drop those that do not fit
+	Events func(Event)
+
+	// Number of times the download was started over because the resource changed
+	restarts int
+}
+
+// Number of times a download is started over before giving up on a resource that keeps changing
+const maxRestarts = 3
+
+// Result describes a completed download
+type Result struct {
+	Path         string // Where the resource was saved, Stdout if streamed
+	Bytes        int64  // Size of the resource
+	Capabilities Capabilities
+	Checksums    []Checksum // Checksums the download was verified against
+	Duration     time.Duration
+	Connections  int           // Number of concurrent connections used, or settled on with AutoConcurrency
+	Mirrors      []MirrorStats // How each URL of a parallel download fared, starting with Request.URL
+}
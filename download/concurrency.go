@@ -0,0 +1,129 @@
+package download
+
+import (
+	"context"
+	"sync"
+)
+
+// concurrency limits the number of workers of a download that run at once.
+// Workers are numbered, and those numbered level or above wait until level rises again.
+// A worker that is running when level drops below it has its span cancelled, so it can hand it back
+type concurrency struct {
+	mu      sync.Mutex
+	level   int
+	settled int                        // Level reported at the end of the download
+	changed chan struct{}              // Closed when level changes
+	running map[int]context.CancelFunc // Cancels the span each running worker is downloading
+}
+
+func newConcurrency(level int) *concurrency {
+	return &concurrency{
+		level:   level,
+		settled: level,
+		changed: make(chan struct{}),
+		running: make(map[int]context.CancelFunc),
+	}
+}
+
+// wait blocks until worker id may run, returning false if ctx is cancelled first
+func (c *concurrency) wait(ctx context.Context, id int) bool {
+	for {
+		c.mu.Lock()
+		level, changed := c.level, c.changed
+		c.mu.Unlock()
+		if id < level {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// start registers cancel as the way to stop worker id once it may no longer run
+func (c *concurrency) start(id int, cancel context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id >= c.level {
+		cancel()
+		return
+	}
+	c.running[id] = cancel
+}
+
+// stop unregisters worker id once it is done with its span
+func (c *concurrency) stop(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.running, id)
+}
+
+// set changes the level, stopping the running workers numbered level or above.
+// settled is the level to report if the download ends now
+func (c *concurrency) set(level int, settled int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settled = settled
+	if level == c.level {
+		return
+	}
+	c.level = level
+	for id, cancel := range c.running {
+		if id >= level {
+			cancel()
+		}
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *concurrency) settledLevel() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settled
+}
+
+// autoGain is how much more throughput a step up in connections has to bring to be kept
+const autoGain = 0.05
+
+// autoTuner picks the number of connections of a download the way TCP congestion control
+// picks its window: starting with one, doubling while throughput keeps growing, then adding
+// one at a time, and halving on errors. A step up that brings no more throughput is undone
+type autoTuner struct {
+	max       int
+	level     int
+	prev      int     // Level before the last step up, 0 if the last step was not one
+	slowStart bool    // Doubling rather than adding connections
+	best      float64 // Highest throughput in bytes/s since the last back off
+	bestLevel int     // Level that reached best
+}
+
+func newAutoTuner(max int) *autoTuner {
+	return &autoTuner{max: max, level: 1, slowStart: true, bestLevel: 1}
+}
+
+// step takes the throughput and the number of failed requests over the last interval
+// and returns the level for the next one
+func (t *autoTuner) step(throughput float64, failures int64) int {
+	switch {
+	case failures > 0:
+		// Back off, and measure again from the lower level
+		t.level, t.prev, t.slowStart, t.best = (t.level+1)/2, 0, false, 0
+	case throughput > t.best*(1+autoGain):
+		t.best, t.bestLevel, t.prev = throughput, t.level, t.level
+		if t.slowStart {
+			t.level *= 2
+		} else {
+			t.level++
+		}
+	case t.prev > 0:
+		// The connections added last did not help
+		t.level, t.prev, t.slowStart = t.prev, 0, false
+	}
+	if t.level > t.max {
+		t.level = t.max
+	}
+	return t.level
+}
@@ -0,0 +1,99 @@
+package download
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+  Tests for adaptive concurrency
+*/
+
+func TestAutoTuner(t *testing.T) {
+	tuner := newAutoTuner(8)
+	steps := []struct {
+		throughput float64
+		failures   int64
+		level      int
+	}{
+		{100, 0, 2},  // Slow start doubles while throughput grows
+		{200, 0, 4},  //
+		{400, 0, 8},  // Capped at the max
+		{410, 0, 4},  // Undo a step that did not help
+		{410, 0, 4},  // and hold
+		{410, 2, 2},  // Halve on errors
+		{200, 0, 3},  // then add one at a time
+		{300, 0, 4},  //
+		{300, 0, 3},  //
+		{300, 1, 2},  //
+		{100, 5, 1},  // Never below one
+		{100, 5, 1},  //
+		{100, 0, 2},  //
+		{200, 0, 3},  //
+		{150, 0, 2},  //
+		{1000, 0, 3}, //
+	}
+	for i, step := range steps {
+		if level := tuner.step(step.throughput, step.failures); level != step.level {
+			t.Fatalf("step %d: expected level %d, got %d", i, step.level, level)
+		}
+	}
+	if tuner.bestLevel != 2 {
+		t.Errorf("expected to settle on 2 connections, got %d", tuner.bestLevel)
+	}
+}
+
+// Workers above the level wait, and running ones are stopped when it drops below them
+func TestConcurrency(t *testing.T) {
+	conc := newConcurrency(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if !conc.wait(ctx, 1) {
+		t.Error("worker 1 of 2 not allowed to run")
+	}
+	if conc.wait(ctx, 2) {
+		t.Error("worker 2 of 2 allowed to run")
+	}
+
+	spanCtx, cancelSpan := context.WithCancel(context.Background())
+	defer cancelSpan()
+	conc.start(1, cancelSpan)
+	conc.set(1, 1)
+	if spanCtx.Err() == nil {
+		t.Error("worker 1 kept running at a level of 1")
+	}
+	allowed := make(chan bool)
+	go func() { allowed <- conc.wait(context.Background(), 1) }()
+	conc.set(2, 2)
+	if !<-allowed {
+		t.Error("worker 1 not woken up at a level of 2")
+	}
+}
+
+func TestDownloadParallelAuto(t *testing.T) {
+	downloadTest, err := ioutil.TempFile(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadTest.Close()
+	defer os.Remove(downloadTest.Name())
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.AutoConcurrency, opts.AutoInterval = true, time.Millisecond
+	opts.ChunkSize = 1000
+	state := newState(url, Capabilities{ChunkType: "bytes", Length: TestFileSize, CanRange: true}, opts.ChunkSize, "")
+	connections, err := NewClient(opts).downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connections < 1 || connections > opts.NThreads {
+		t.Errorf("settled on %d connections, expected 1 to %d", connections, opts.NThreads)
+	}
+	checkDownloadedFile(t, downloadTest.Name())
+}
@@ -0,0 +1,92 @@
+package download
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Digest algorithm names used in HTTP headers, and the matching Checksum algorithm
+// Algorithms we cannot compute (e.g. unixsum, adler32) are skipped
+var digestAlgorithms = map[string]string{
+	"md5":     "md5",
+	"sha":     "sha1",
+	"sha1":    "sha1",
+	"sha-256": "sha256",
+	"sha256":  "sha256",
+	"sha-512": "sha512",
+	"sha512":  "sha512",
+	"crc32c":  "crc32c",
+}
+
+// serverDigests collects every whole-file digest the server advertised in its headers:
+// RFC 3230 Digest, RFC 9530 Repr-Digest, Content-MD5, Google Cloud Storage's x-goog-hash
+// and S3's x-amz-checksum-*. Digests of an encoded body describe bytes we never see, so
+// nothing is collected when a Content-Encoding is in use
+func serverDigests(header http.Header) (digests []Checksum) {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+	add := func(source string, algorithm string, value string) {
+		algorithm, ok := digestAlgorithms[strings.ToLower(strings.TrimSpace(algorithm))]
+		if !ok {
+			return
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return
+		}
+		checksum, err := newChecksum(algorithm, hex.EncodeToString(sum))
+		if err != nil {
+			return
+		}
+		checksum.Source = source + " header"
+		digests = append(digests, checksum)
+	}
+
+	// Digest: SHA-256=<base64>, MD5=<base64>
+	for _, pair := range headerList(header, "Digest") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			add("Digest", kv[0], kv[1])
+		}
+	}
+	// Repr-Digest: sha-256=:<base64>:, sha-512=:<base64>:
+	for _, pair := range headerList(header, "Repr-Digest") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			value := strings.SplitN(kv[1], ";", 2)[0]
+			add("Repr-Digest", kv[0], strings.Trim(strings.TrimSpace(value), ":"))
+		}
+	}
+	// Content-MD5: <base64>
+	if value := header.Get("Content-MD5"); value != "" {
+		add("Content-MD5", "md5", value)
+	}
+	// x-goog-hash: crc32c=<base64>, md5=<base64>, possibly as separate headers
+	for _, pair := range headerList(header, "X-Goog-Hash") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			add("x-goog-hash", kv[0], kv[1])
+		}
+	}
+	// x-amz-checksum-<algorithm>: <base64>, where multipart uploads
+	// have a checksum of part checksums suffixed with -<parts> which we cannot verify
+	for _, algorithm := range []string{"sha256", "sha1", "crc32c"} {
+		name := "X-Amz-Checksum-" + algorithm
+		if value := header.Get(name); value != "" && !strings.Contains(value, "-") {
+			add(strings.ToLower(name), algorithm, value)
+		}
+	}
+	return
+}
+
+// headerList splits every value of a comma separated list header into its trimmed elements
+func headerList(header http.Header, name string) (elements []string) {
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package download
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+/*
+  Tests for server provided digests
+*/
+
+func TestServerDigests(t *testing.T) {
+	sha := sha256.Sum256([]byte("hello"))
+	md := md5.Sum([]byte("hello"))
+	sha64 := base64.StdEncoding.EncodeToString(sha[:])
+	md64 := base64.StdEncoding.EncodeToString(md[:])
+	digestTests := []struct {
+		header   http.Header
+		expected []string
+	}{
+		{http.Header{"Digest": {"SHA-256=" + sha64 + ", MD5=" + md64}}, []string{"Digest header sha256", "Digest header md5"}},
+		{http.Header{"Digest": {"UNIXsum=30637"}}, nil},
+		{http.Header{"Repr-Digest": {"sha-256=:" + sha64 + ":, unknown=:AAAA:"}}, []string{"Repr-Digest header sha256"}},
+		{http.Header{"Content-Md5": {md64}}, []string{"Content-MD5 header md5"}},
+		{http.Header{"X-Goog-Hash": {"crc32c=n03x6A==", "md5=" + md64}}, []string{"x-goog-hash header crc32c", "x-goog-hash header md5"}},
+		{http.Header{"X-Amz-Checksum-Sha256": {sha64}}, []string{"x-amz-checksum-sha256 header sha256"}},
+		{http.Header{"X-Amz-Checksum-Sha256": {sha64 + "-3"}}, nil},
+		{http.Header{"Digest": {"SHA-256=" + sha64}, "Content-Encoding": {"gzip"}}, nil},
+		{http.Header{"Digest": {"SHA-256=not base64!"}}, nil},
+	}
+	for _, test := range digestTests {
+		digests := serverDigests(test.header)
+		if len(digests) != len(test.expected) {
+			t.Errorf("headers %v: expected %d digests, got %v", test.header, len(test.expected), digests)
+			continue
+		}
+		for i, digest := range digests {
+			if got := digest.Source + " " + digest.Algorithm; got != test.expected[i] {
+				t.Errorf("headers %v: expected %s, got %s", test.header, test.expected[i], got)
+			}
+		}
+	}
+}
+
+func TestDownloadServerDigest(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	url, err := getTestURL("/digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := testClient.Download(context.Background(), Request{URL: url, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Checksums) != 1 || res.Checksums[0].Source != "Repr-Digest header" {
+		t.Errorf("expected download verified against Repr-Digest, got %v", res.Checksums)
+	}
+
+	url, err = getTestURL("/digest?corrupt=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testClient.Download(context.Background(), Request{URL: url, Dir: dir})
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) || checksumErr.Source != "Repr-Digest header" {
+		t.Errorf("expected Repr-Digest mismatch, got %v", err)
+	}
+	_, err = testClient.Download(context.Background(), Request{URL: url, Dir: dir, IgnoreServerDigests: true})
+	if err != nil {
+		t.Errorf("expected server digest to be ignored, got %v", err)
+	}
+}
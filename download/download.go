@@ -1,28 +1,37 @@
 package download
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/stephng3/DoubleUp/constants"
+	"hash"
 	"io"
-	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Chunk represents a HTTP Range Request which has yet to be completed
-// goroutines pop off these chunks from a queue
-// if the same chunk was reattempted MaxAttempts times,
+// goroutines issue one for whatever is left of the span they are working on,
+// if the same span failed MaxAttempts times without progress,
 // abort and report error
 type Chunk struct {
 	OffsetWriter
 	URL       *url.URL
 	chunkType string
 	start     int64
-	end       int64
-	attempt   int
+	end       int64 // One past the last byte of the chunk
+	total     int64 // Length of the whole resource
+	// Validators of the version of the resource the chunk must come from
+	etag         string
+	lastModified string
 }
 
 // OffsetWriter allows us to abstract away the problem of piecing together the downloaded chunks
@@ -38,134 +47,360 @@ func (dst *OffsetWriter) Write(b []byte) (n int, err error) {
 	return
 }
 
-// Initialize global client for reuse
-// See https://golang.org/pkg/net/http/#pkg-overview
-var client = &http.Client{}
+// Capabilities describes what an endpoint reported about a resource in response to a HEAD request
+type Capabilities struct {
+	ChunkType    string // Unit of range requests, usually "bytes"
+	Length       int64
+	CanRange     bool
+	ETag         string
+	LastModified string
+	Filename     string     // Suggested by the Content-Disposition header
+	Digests      []Checksum // Whole-file digests sent along by the server
+}
 
 // Launch a HEAD request to find out endpoint capabilities
-func getEndpointCapabilities(URL *url.URL) (chunkType string, length int, canRange bool, err error) {
-	header, err := http.Head(URL.String())
+func (c *Client) getEndpointCapabilities(ctx context.Context, URL *url.URL) (caps Capabilities, err error) {
+	release, err := c.acquireHost(ctx, URL)
+	if err != nil {
+		return
+	}
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", URL.String(), nil)
+	if err != nil {
+		return
+	}
+	header, err := c.http.Do(req)
 	if err != nil {
 		return
 	}
-	chunkType = header.Header.Get("Accept-Ranges")
+	header.Body.Close()
+	// Only a missing resource is given up on, servers rejecting HEAD requests (e.g. 403 for presigned URLs)
+	// may well serve GET ones, which are left to be downloaded in a single stream
+	if header.StatusCode == http.StatusNotFound || header.StatusCode == http.StatusGone {
+		return caps, &StatusError{Code: header.StatusCode, Status: header.Status}
+	}
+	if header.StatusCode >= 400 {
+		return caps, ErrRangeUnsupported
+	}
+	caps.ChunkType = header.Header.Get("Accept-Ranges")
+	caps.ETag = header.Header.Get("ETag")
+	caps.LastModified = header.Header.Get("Last-Modified")
+	caps.Filename = filenameFromDisposition(header.Header.Get("Content-Disposition"))
+	caps.Digests = serverDigests(header.Header)
 	lengthString := header.Header.Get("Content-Length")
 	if lengthString != "" {
-		length, err = strconv.Atoi(lengthString)
+		caps.Length, err = strconv.ParseInt(lengthString, 10, 64)
 	}
 	if err != nil {
 		return
 	}
-	if len(chunkType) < 1 || chunkType == "none" {
-		canRange = false
-		err = errors.New("endpoint does not support range requests")
+	// Ranges are of no use without a length to split the resource by
+	if len(caps.ChunkType) < 1 || caps.ChunkType == "none" || caps.Length <= 0 {
+		caps.CanRange = false
+		err = ErrRangeUnsupported
 	} else {
-		canRange = true
+		caps.CanRange = true
 	}
 	return
 }
 
 // Concurrent goroutines launching range requests to downloadSingleThreaded pieces of a file
-func downloadParallel(chunkType string, length int, URL *url.URL, w io.WriterAt, c int, chunkSize int64, maxAttempts int) error {
-	// Initialize tasks and put it into queue
-	// Unfortunately we can't close the channel after the initial task generation
-	// since failed tasks have a certain number (MaxAttempts) of re-tries before giving up
-	chunkChan := make(chan Chunk)
-	nTasks := int64(length)/chunkSize + 1
-	go func() {
-		for i := int64(0); i < nTasks; i++ {
-			chunk := Chunk{
-				OffsetWriter: OffsetWriter{
-					WriterAt: w,
-					offset:   i * chunkSize,
-				},
-				URL:       URL,
-				chunkType: chunkType,
-				start:     i * chunkSize,
-				end:       int64(math.Min(float64(length), float64((i+1)*chunkSize))),
-				attempt:   0,
-			}
-			chunkChan <- chunk
-		}
-	}()
+// Only chunks not yet marked complete in state are fetched, each goroutine taking a large span of them
+// at a time and stealing from the others once it runs out (see scheduler).
+// At the tail, idle goroutines fetch the slowest spans again and the first copy to arrive wins.
+// Every request goes to whichever of mirrors is expected to answer it first (see mirrorSet).
+// State is saved every time another chunk completes.
+// With AutoConcurrency, the number of goroutines downloading at once is tuned as the download goes,
+// otherwise it is NThreads. The number of connections it settled on is returned.
+// Cancelling ctx aborts every in-flight request, and all goroutines have exited by the time this returns
+func (c *Client) downloadParallel(ctx context.Context, chunkType string, mirrors *mirrorSet, w io.WriterAt, state *State) (int, error) {
+	nTasks := state.nChunks() - state.nCompleted()
+	sched := newScheduler(state, c.NThreads)
+	r := state.reporter
+	conc := newConcurrency(c.NThreads)
+	if c.AutoConcurrency {
+		conc = newConcurrency(1)
+	}
 
-	// Make channels for goroutines to report success or failure of individual chunks
-	progressChan := make(chan bool)
+	// Make channels for goroutines to report success of individual chunks, or failure
+	progressChan := make(chan int64)
 	errorsChan := make(chan error)
 
-	// Launch c goroutines which pop tasks from queue and downloads the chunks
+	// Failed requests wait before being retried, and every worker holds off while a server
+	// has asked us to (Retry-After). All retries count against the download's retry budget
+	gate := &retryGate{}
+	var retries int64
+	// Failed requests since the concurrency was last tuned
+	var failures int64
+
+	// Cancelling the context on the way out stops the workers,
+	// waiting on them guarantees none outlive this call
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	fail := func(err error) {
+		select {
+		case errorsChan <- err:
+		case <-ctx.Done():
+		}
+	}
+	complete := func(i int64) error {
+		select {
+		case progressChan <- i:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// work has goroutine id download what is left of sp, retrying it if the goroutine owns it.
+	// It returns false once the goroutine must stop
+	work := func(id int, sp *span, owner bool) bool {
+		attempt := 0
+		// The span's context is cancelled as soon as any goroutine downloading it finishes it,
+		// or when the concurrency drops below id
+		spanCtx, cancelSpan := context.WithCancel(ctx)
+		defer cancelSpan()
+		sched.join(sp, cancelSpan)
+		conc.start(id, cancelSpan)
+		defer conc.stop(id)
+		for sched.remaining(sp) {
+			err := gate.wait(spanCtx)
+			var m *mirror
+			if err == nil {
+				m = mirrors.pick()
+				start, end := sched.byteRange(sp)
+				sw := &spanWriter{WriterAt: w, sched: sched, span: sp, complete: complete}
+				if state.pieces != nil {
+					sw.pieces = newPieceHasher(state.pieces, state.Length)
+				}
+				chunk := Chunk{
+					OffsetWriter: OffsetWriter{
+						WriterAt: sw,
+						offset:   start,
+					},
+					URL:       m.URL,
+					chunkType: chunkType,
+					start:     start,
+					end:       end,
+					total:     state.Length,
+					// Chunks must match the version of the resource the mirror had when the download started
+					etag:         m.etag,
+					lastModified: m.lastModified,
+				}
+				began := time.Now()
+				r.chunkStarted(id, m.URL, start, end, attempt, &sw.written)
+				err = c.downloadChunk(spanCtx, chunk)
+				r.chunkDone(id)
+				if mirrors.finish(m, atomic.LoadInt64(&sw.written), time.Since(began), err != nil && spanCtx.Err() == nil) {
+					r.emit(Event{Type: EventMirrorDropped, URL: m.URL, Err: fmt.Errorf("%d failures in a row", constants.MirrorMaxFailures)})
+				}
+			}
+			if ctx.Err() != nil {
+				return false
+			}
+			if spanCtx.Err() != nil {
+				// Another goroutine finished the span first, or this one has to stop
+				break
+			}
+			if errors.Is(err, ErrRangeUnsupported) || errors.Is(err, ErrResourceChanged) {
+				// Retrying is pointless, every other chunk will be answered the same way by this mirror
+				if mirrors.drop(m) {
+					r.emit(Event{Type: EventMirrorDropped, URL: m.URL, Err: err})
+					continue
+				}
+				fail(err)
+				return false
+			}
+			if err == nil {
+				continue
+			}
+			atomic.AddInt64(&failures, 1)
+			if !owner {
+				// Retrying is left to the owner of the span
+				return true
+			}
+			// Retry what is left of the span if there was some error in downloading
+			start, end := sched.byteRange(sp)
+			attempt = sched.failed(sp)
+			if attempt >= c.MaxAttempts {
+				fail(&RetryError{Start: start, End: end, Attempts: attempt, Err: err})
+				return false
+			}
+			if c.RetryBudget > 0 && atomic.AddInt64(&retries, 1) > int64(c.RetryBudget) {
+				fail(&RetryError{Start: start, End: end, Attempts: attempt, Budget: c.RetryBudget, Err: err})
+				return false
+			}
+			r.emit(Event{Type: EventChunkRetried, Connection: id, URL: m.URL, Start: start, End: end, Attempt: attempt, Err: err})
+			delay := backoffDelay(attempt, c.RetryBaseDelay, c.RetryMaxDelay)
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+				delay = statusErr.RetryAfter
+				gate.delay(delay)
+			}
+			if sleep(spanCtx, delay) != nil {
+				if ctx.Err() != nil {
+					return false
+				}
+				break
+			}
+		}
+		if sched.remaining(sp) {
+			// Stopped for a lower concurrency, someone else can carry on with the span
+			if owner {
+				sched.release(sp)
+			}
+			return true
+		}
+		sched.done(sp)
+		return true
+	}
+
+	// Launch c goroutines which take spans from the scheduler and download them
 	// A goroutine that meets an error pushes it into the errorChan
-	// whereupon all tasks are popped off the task queue
-	// and the main routine reports the error
-	for i := 0; i < c; i++ {
+	// whereupon the main routine cancels the remaining work and reports the error.
+	// Once there is nothing left to take, goroutines enter the end game and race the slowest
+	// span still being downloaded, waiting for the rest to finish when there is nothing left to help with either
+	wg.Add(c.NThreads)
+	for i := 0; i < c.NThreads; i++ {
+		go func(id int) {
+			defer wg.Done()
+			for conc.wait(ctx, id) {
+				sp, owner := sched.take(), true
+				if sp == nil {
+					sp, owner = sched.duplicate(), false
+				}
+				if sp == nil {
+					changed, finished := sched.idle()
+					if finished {
+						return
+					}
+					select {
+					case <-changed:
+						continue
+					case <-ctx.Done():
+						return
+					}
+				}
+				if !work(id, sp, owner) {
+					return
+				}
+			}
+		}(i)
+	}
+
+	// Tune the concurrency to the throughput of the last interval
+	if c.AutoConcurrency {
+		wg.Add(1)
 		go func() {
-			for chunk := range chunkChan {
-				if chunk.attempt == maxAttempts {
-					errStr := fmt.Sprintf("too many attempts downloading range %d to %d", chunk.start, chunk.end)
-					errorsChan <- errors.New(errStr)
+			defer wg.Done()
+			tuner := newAutoTuner(c.NThreads)
+			ticker := time.NewTicker(c.AutoInterval)
+			defer ticker.Stop()
+			last, lastWritten := time.Now(), int64(0)
+			for {
+				select {
+				case <-ctx.Done():
 					return
+				case now := <-ticker.C:
+					written := atomic.LoadInt64(&sched.written)
+					throughput := float64(written-lastWritten) / now.Sub(last).Seconds()
+					last, lastWritten = now, written
+					conc.set(tuner.step(throughput, atomic.SwapInt64(&failures, 0)), tuner.bestLevel)
 				}
-				err := downloadChunk(chunk)
-				if err != nil {
-					// Put chunk back into queue if there was some error in downloading
-					_, printErr := fmt.Fprintf(os.Stderr, "\nAttempt %d: Download of range %d-%d %s failed:\n %v\n",
-						chunk.attempt+1, chunk.start, chunk.end, chunk.chunkType, err)
-					if printErr != nil {
-						errorsChan <- printErr
-					}
-					chunk.attempt += 1
-					chunkChan <- chunk
-				} else {
-					// Emit success only if chunk successfully downloaded
-					progressChan <- true
+			}
+		}()
+	}
+
+	// Report the transfers in flight every so often
+	if r.active() {
+		r.track(sched.partial)
+		defer r.track(nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(constants.DefaultProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					r.tick()
 				}
 			}
 		}()
 	}
 
-	// Display progress for user experience
-	_, err := fmt.Fprintf(os.Stdout, "Progress: 0 of %d", nTasks)
-	if err != nil {
-		return err
+	if err := state.save(); err != nil {
+		return 0, err
 	}
 	for i := int64(1); i < nTasks+1; i++ {
 		// Fan-in
 		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
 		case err := <-errorsChan:
-			// Error has occurred, close task queue and pop off all remaining tasks
-			close(chunkChan)
-			for range chunkChan {
+			return 0, err
+		case index := <-progressChan:
+			// Consume a progress signal, record it and report it
+			state.markComplete(index)
+			if err := state.save(); err != nil {
+				return 0, err
 			}
-			return err
-		case <-progressChan:
-			// Consume a progress signal and update progress
-			_, err = fmt.Fprintf(os.Stdout, "\rProgress: %d of %d", i, nTasks)
+			r.chunkCompleted(index*state.ChunkSize, state.chunkEnd(index))
 		}
 	}
-	// Close chunkChan after all chunks have successfully downloaded
-	close(chunkChan)
-	return nil
+	return conc.settledLevel(), nil
 }
 
 // A single range request and corresponding write to the OffsetWriter
-func downloadChunk(chunk Chunk) error {
+func (c *Client) downloadChunk(parent context.Context, chunk Chunk) error {
+	// Time spent waiting for a connection to the host does not count against the chunk
+	release, err := c.acquireHost(parent, chunk.URL)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// A chunk gets ChunkTimeout in total, and is abandoned early if it stalls
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.ChunkTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, c.ChunkTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+
 	// Build ranged http get request
-	header := http.Header{
-		"Range": []string{chunk.chunkType + "=" + strconv.FormatInt(chunk.start, 10) + "-" + strconv.FormatInt(chunk.end, 10)},
+	req, err := http.NewRequestWithContext(ctx, "GET", chunk.URL.String(), nil)
+	if err != nil {
+		return err
 	}
-	req := &http.Request{
-		Method: "GET",
-		URL:    chunk.URL,
-		Header: header,
+	req.Header.Set("Range", rangeHeader(chunk))
+	if ifRange := ifRangeHeader(chunk.etag, chunk.lastModified); ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
 	}
-	res, err := client.Do(req)
+	res, err := c.http.Do(req)
 	if err != nil {
+		return c.chunkTimeoutError(parent, err)
+	}
+	defer res.Body.Close()
+	// Make sure we got the bytes we asked for before writing them at the chunk's offset
+	if err := validateRangeResponse(res, chunk); err != nil {
 		return err
 	}
 	// Copy bytes to destination
-	written, err := io.CopyN(&chunk, res.Body, chunk.end-chunk.start)
+	written, err := c.copyBody(ctx, &chunk, res.Body, chunk.end-chunk.start, cancel)
+	if errors.Is(err, errSpanDone) {
+		// The rest of the range was stolen by another worker
+		return nil
+	}
 	if err != nil {
-		return err
+		return c.chunkTimeoutError(parent, err)
 	}
 	if written != chunk.end-chunk.start {
 		return fmt.Errorf("wrong number of bytes copied: expected %d, got %d", chunk.end-chunk.start, written)
@@ -174,60 +409,337 @@ func downloadChunk(chunk Chunk) error {
 }
 
 // Single threaded downloader
-func downloadSingleThreaded(URL *url.URL, w io.Writer) error {
-	res, err := http.Get(URL.String())
-	defer res.Body.Close()
-
+func (c *Client) downloadSingleThreaded(ctx context.Context, URL *url.URL, w io.Writer) (int64, error) {
+	release, err := c.acquireHost(ctx, URL)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	_, err = io.CopyN(w, res.Body, res.ContentLength)
+	defer release()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", URL.String(), nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	res, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, &StatusError{Code: res.StatusCode, Status: res.Status, RetryAfter: parseRetryAfter(res)}
+	}
+	// Servers may stream the body without announcing its length, in which case ContentLength is -1
+	return c.copyBody(ctx, w, res.Body, res.ContentLength, cancel)
+}
+
+// copyBody copies n bytes of body to w, or all of it if n is negative, within the Client's rate limits.
+// The transfer is abandoned through cancel if it stalls, reported as ErrStalled
+func (c *Client) copyBody(ctx context.Context, w io.Writer, body io.Reader, n int64, cancel context.CancelFunc) (written int64, err error) {
+	pauses := &pauseClock{}
+	r := &countingReader{Reader: c.limitReader(ctx, body, pauses)}
+	stop := watchTransfer(r, pauses, c.IdleTimeout, c.MinSpeed, c.StallTime, cancel)
+	if n < 0 {
+		written, err = io.Copy(w, r)
+	} else {
+		written, err = io.CopyN(w, r, n)
+	}
+	if stalled := stop(); stalled != nil {
+		return written, stalled
+	}
+	return written, err
+}
+
+// chunkTimeoutError explains an error caused by a chunk running out of ChunkTimeout
+func (c *Client) chunkTimeoutError(parent context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+		return fmt.Errorf("chunk not downloaded within %v: %w", c.ChunkTimeout, err)
+	}
+	return err
 }
 
 // Downloader: Driver code for choosing the right download methods to call
-func Downloader(nThreads int, resource *url.URL, chunkSize int64, maxAttempts int) error {
-	// Downloader saves the result into a file with an escaped name
-	// In the future, we can do a <src> <dst> format
-	// to allow specification of a destination filename
-	f, err := os.Create(strings.Replace(resource.String(), "/", "_", -1))
+// If resume is set, progress saved by an earlier parallel download of the same resource is picked up
+//
+// Deprecated: Downloader cannot be cancelled, use Client.Download instead
+func Downloader(nThreads int, resource *url.URL, chunkSize int64, maxAttempts int, resume bool) error {
+	c := NewClient(Options{NThreads: nThreads, ChunkSize: chunkSize, MaxAttempts: maxAttempts})
+	_, err := c.Download(context.Background(), Request{URL: resource, Resume: resume})
+	return err
+}
+
+// Download fetches req.URL, in parallel if the endpoint supports range requests.
+// Cancelling ctx aborts the download. Progress of a parallel download is kept in
+// its sidecar file, so it can be picked up again with Request.Resume.
+// How the download goes is reported to req.Events, ending with EventFinished or EventFailed.
+// Errors can be told apart with errors.Is and errors.As, see errors.go
+func (c *Client) Download(ctx context.Context, req Request) (*Result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	// Requests of the download share the hosts fairly with other downloads
+	ctx = context.WithValue(ctx, downloadKey{}, new(int))
+	r := newReporter(req.Events)
+	res, err := c.download(ctx, req, r)
+	if errors.Is(err, syscall.ENOSPC) {
+		err = diskFullError{err}
+	}
 	if err != nil {
-		return err
+		r.emit(Event{Type: EventFailed, Err: err})
+		return nil, err
 	}
-	defer f.Close()
-	fmt.Println(f.Name())
+	r.emit(Event{Type: EventFinished, Result: res})
+	return res, nil
+}
 
-	chunkType, length, canRange, err := getEndpointCapabilities(resource)
+// download does the work of Download, calling itself again to start over
+func (c *Client) download(ctx context.Context, req Request, r *reporter) (*Result, error) {
+	began := time.Now()
+	resource := req.URL
+	toStdout := req.Output == Stdout
+
+	caps, err := c.getEndpointCapabilities(ctx, resource)
+	if err != nil && !errors.Is(err, ErrRangeUnsupported) {
+		return nil, err
+	}
+	r.start(caps.Length, 0)
+	r.emit(Event{Type: EventProbed, Capabilities: &caps})
 	if err != nil {
-		if strings.Contains(err.Error(), "endpoint does not support range requests") {
-			fmt.Println("Endpoint does not support range requests, defaulting to single threaded mode")
+		r.noticef("Endpoint does not support range requests, defaulting to single threaded mode")
+	}
+
+	if req.Size > 0 && caps.Length != req.Size {
+		return nil, fmt.Errorf("resource is %d bytes, expected %d", caps.Length, req.Size)
+	}
+	if req.Pieces != nil {
+		if err := req.Pieces.validate(caps.Length); err != nil {
+			return nil, err
+		}
+	}
+
+	// Look up the expected checksum before spending any time downloading
+	name := outputPath(req, caps)
+	expected := req.Checksums
+	if req.ChecksumFile != "" {
+		lookupName := filepath.Base(name)
+		if toStdout {
+			lookupName = defaultFilename(resource, caps)
+		}
+		checksum, err := LookupChecksum(req.ChecksumFile, lookupName)
+		if err != nil {
+			return nil, err
+		}
+		expected = append(expected, checksum)
+	}
+	checksums := expected
+	if !req.IgnoreServerDigests {
+		checksums = append(checksums[:len(checksums):len(checksums)], caps.Digests...)
+	}
+
+	// Streaming to stdout can only be done in order, a single request at a time
+	// Checksums are computed on the fly since the output cannot be read back
+	if toStdout {
+		w := io.Writer(os.Stdout)
+		hashes := make([]hash.Hash, len(checksums))
+		for i, checksum := range checksums {
+			if hashes[i], err = newHash(checksum.Algorithm); err != nil {
+				return nil, err
+			}
+			w = io.MultiWriter(w, hashes[i])
+		}
+		var pw *pieceWriter
+		if req.Pieces != nil {
+			pw = newPieceWriter(w, req.Pieces, caps.Length)
+			w = pw
+		}
+		if r.active() {
+			w = &progressWriter{Writer: w, reporter: r}
+		}
+		r.emit(Event{Type: EventStarted, Path: Stdout})
+		written, err := c.downloadSingleThreaded(ctx, resource, w)
+		if err != nil {
+			return nil, err
+		}
+		if pw != nil {
+			if err := pw.check(); err != nil {
+				return nil, err
+			}
+		}
+		for i, checksum := range checksums {
+			if err := compareChecksum(hashes[i], Stdout, checksum); err != nil {
+				return nil, err
+			}
+		}
+		return &Result{
+			Path:         Stdout,
+			Bytes:        written,
+			Capabilities: caps,
+			Checksums:    checksums,
+			Duration:     time.Since(began),
+			Connections:  1,
+		}, nil
+	}
+
+	if dir := filepath.Dir(name); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// Pick up saved progress if asked to, as long as the resource has not changed since
+	var state *State
+	if req.Resume && caps.CanRange {
+		var saved string
+		state, saved, err = findState(name, req.Clobber, resource)
+		if os.IsNotExist(err) {
+			r.noticef("No saved state found, starting from scratch")
+		} else if err != nil {
+			return nil, err
+		} else if !state.matches(resource, caps) {
+			r.noticef("Resource has changed since the saved state was written, starting from scratch")
+			state = nil
+		} else if req.Pieces != nil && state.ChunkSize%req.Pieces.Length != 0 {
+			r.noticef("Saved state does not line up with the piece checksums, starting from scratch")
+			state = nil
 		} else {
-			return err
+			// The download may have been saved under another name by AutoRename
+			name = saved
+			r.noticef("Resuming download, %d of %d chunks already completed", state.nCompleted(), state.nChunks())
 		}
 	}
 
+	// Existing content is only kept when resuming,
+	// otherwise the clobber policy decides what happens to it
+	flags, policy := os.O_RDWR|os.O_CREATE, Overwrite
+	if state == nil {
+		flags |= os.O_TRUNC
+		policy = req.Clobber
+	}
+	name, release, err := c.outputs.reserve(name, policy, ctx.Value(downloadKey{}))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	f, err := os.OpenFile(name, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if state != nil {
+		r.start(caps.Length, state.completedBytes())
+	}
+	r.emit(Event{Type: EventStarted, Path: f.Name()})
+
 	// Truncate allocates <length> bytes for the file and fills them with empty bytes
 	// This allows us to call WriteAt at any position before EOF
 	// and write chunks concurrently
-	if err := f.Truncate(int64(length)); err != nil {
-		return err
+	if err := f.Truncate(caps.Length); err != nil {
+		return nil, err
 	}
 
-	if nThreads == 1 || !canRange {
+	// Pieces can only be verified one chunk at a time, which takes the parallel code path
+	parallel := caps.CanRange && (c.NThreads > 1 || state != nil || req.Pieces != nil)
+	connections, written := 1, caps.Length
+	var mirrors *mirrorSet
+	if parallel {
+		if state == nil {
+			// The bytes fetched to tune the chunk size count towards the download
+			chunkSize, probed := c.ChunkSize, int64(0)
+			if req.Pieces != nil {
+				// Chunks are made of whole pieces, so that each can be verified on its own
+				chunkSize = pieceChunkSize(chunkSize, req.Pieces.Length)
+			} else if c.AutoChunkSize {
+				chunkSize, probed, err = c.tuneChunkSize(ctx, r, caps, resource, f)
+				if probed > 0 {
+					r.noticef("Chunk size tuned to %s", FormatSize(chunkSize))
+				}
+			}
+			state = newState(resource, caps, chunkSize, statePath(name))
+			for i := int64(0); i < state.nChunks() && state.chunkEnd(i) <= probed; i++ {
+				state.markComplete(i)
+			}
+		}
+		state.pieces, state.reporter = req.Pieces, r
+		r.start(state.Length, state.completedBytes())
+		if err == nil {
+			// Spread the download across every mirror serving the same resource
+			mirrors = c.probeMirrors(ctx, r, newMirror(resource, state.ETag, state.LastModified), caps, req.Mirrors)
+			connections, err = c.downloadParallel(ctx, caps.ChunkType, mirrors, f, state)
+		}
+		if errors.Is(err, ErrResourceChanged) && c.RestartOnChange && req.restarts < maxRestarts {
+			// Start over in the same file, from a fresh look at the new version of the resource
+			r.noticef("%v, restarting download", err)
+			if err := state.remove(); err != nil {
+				return nil, err
+			}
+			if err := f.Close(); err != nil {
+				return nil, err
+			}
+			restart := req
+			restart.Output, restart.Dir, restart.Clobber, restart.Resume = name, "", Overwrite, false
+			restart.Checksums, restart.ChecksumFile = expected, ""
+			restart.restarts++
+			return c.download(ctx, restart, r)
+		} else if errors.Is(err, ErrRangeUnsupported) {
+			// The HEAD request promised range support, but the server ignores Range headers
+			r.noticef("Endpoint ignored a range request, falling back to single threaded mode")
+			parallel, connections = false, 1
+		} else if err != nil {
+			return nil, err
+		}
+		// The sidecar is only needed while the download is incomplete
+		if err := state.remove(); err != nil {
+			return nil, err
+		}
+	}
+	if !parallel {
 		// Fall back to single threaded implementation
-		err = downloadSingleThreaded(resource, f)
-		if err != nil {
-			return err
+		// Pieces are still verified as they stream in, but one that does not match fails the download
+		var w io.Writer = f
+		var pw *pieceWriter
+		if req.Pieces != nil {
+			r.noticef("Pieces cannot be fetched again without range requests, a mismatching piece fails the download")
+			pw = newPieceWriter(w, req.Pieces, caps.Length)
+			w = pw
 		}
-	} else {
-		err = downloadParallel(chunkType, length, resource, f, nThreads, chunkSize, maxAttempts)
+		if r.active() {
+			r.start(caps.Length, 0)
+			w = &progressWriter{Writer: w, reporter: r}
+		}
+		// The length may not have been announced, what was received is what was downloaded
+		written, err = c.downloadSingleThreaded(ctx, resource, w)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if pw != nil {
+			if err := pw.check(); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return nil
+	// A file that fails verification is removed unless asked to keep it for inspection
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := verifyFile(name, checksums); err != nil {
+		if errors.Is(err, ErrChecksumMismatch) && !req.KeepOnMismatch {
+			if removeErr := os.Remove(name); removeErr != nil {
+				return nil, removeErr
+			}
+		}
+		return nil, err
+	}
+
+	return &Result{
+		Path:         name,
+		Bytes:        written,
+		Capabilities: caps,
+		Checksums:    checksums,
+		Duration:     time.Since(began),
+		Connections:  connections,
+		Mirrors:      mirrors.stats(),
+	}, nil
 }
@@ -2,6 +2,9 @@ package download
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/stephng3/DoubleUp/constants"
@@ -15,6 +18,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,12 +28,29 @@ const (
 	ChunkSize      = constants.DefaultChunkSize
 	MaxAttempts    = constants.DefaultMaxAttempts
 	FailAt         = TestFileSize / 2
+	SlowDelay      = 500 * time.Millisecond
+	AttachmentName = "attachment.txt"
 	Addr           = ":13355"
 	TestFilePrefix = "downloader"
 )
 
 var (
 	testFileName string
+	// Range requests served by /changing, /busy, /stall and /lag so far,
+	// and those served by /corrupt which cover FailAt
+	changingRequests int64
+	busyRequests     int64
+	stallRequests    int64
+	lagRequests      int64
+	corruptRequests  int64
+	testClient       = NewClient(testOptions)
+	testOptions      = Options{
+		NThreads:       4,
+		ChunkSize:      ChunkSize,
+		MaxAttempts:    MaxAttempts,
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  10 * time.Millisecond,
+	}
 )
 
 func TestMain(m *testing.M) {
@@ -80,7 +101,7 @@ func TestGetEndpointCapabilities(t *testing.T) {
 	endpointTests := []struct {
 		in        *url.URL
 		chunkType string
-		length    int
+		length    int64
 		canRange  bool
 		error     string
 	}{
@@ -97,7 +118,7 @@ func TestGetEndpointCapabilities(t *testing.T) {
 }
 
 /*
-  Tests for downloadSingleThreaded
+Tests for downloadSingleThreaded
 */
 func TestDownloadSingleThreaded(t *testing.T) {
 	testFile, err := os.Open(testFileName)
@@ -112,7 +133,7 @@ func TestDownloadSingleThreaded(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = downloadSingleThreaded(url, downloadTest)
+	_, err = testClient.downloadSingleThreaded(context.Background(), url, downloadTest)
 	if err != nil {
 		t.Error(err)
 	}
@@ -124,7 +145,7 @@ func TestDownloadSingleThreaded(t *testing.T) {
 }
 
 /*
-  Tests for downloadParallel
+Tests for downloadParallel
 */
 func TestDownloadMultiThreadedSuccess(t *testing.T) {
 	testFile, err := os.Open(testFileName)
@@ -136,7 +157,7 @@ func TestDownloadMultiThreadedSuccess(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = downloadParallel("bytes", TestFileSize, url, downloadTest, 4, ChunkSize, MaxAttempts)
+	_, err = testClient.downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, newTestState(url))
 	if err != nil {
 		t.Error(err)
 	}
@@ -153,10 +174,51 @@ func TestDownloadMultiThreadedFail(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = downloadParallel("bytes", TestFileSize, url, downloadTest, 4, ChunkSize, MaxAttempts)
+	_, err = testClient.downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, newTestState(url))
 	if !strings.Contains(err.Error(), "too many attempts downloading range") {
 		t.Error(err)
 	}
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != MaxAttempts || retryErr.End <= retryErr.Start || !errors.Is(err, ErrRetriesExhausted) {
+		t.Errorf("expected the range given up on, got %v", err)
+	}
+}
+
+// Cancelling the context stops an in-flight download promptly and reports the cancellation
+func TestDownloadMultiThreadedCancel(t *testing.T) {
+	downloadTest, err := ioutil.TempFile(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadTest.Close()
+	defer os.Remove(downloadTest.Name())
+	url, err := getTestURL("/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SlowDelay/2)
+	defer cancel()
+	began := time.Now()
+	_, err = testClient.downloadParallel(ctx, "bytes", testMirrors(url), downloadTest, newTestState(url))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(began); elapsed > SlowDelay {
+		t.Errorf("download took %v to stop after cancellation", elapsed)
+	}
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = testClient.Download(ctx, Request{URL: url})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation, got %v", err)
+	}
 }
 
 /*
@@ -164,23 +226,33 @@ func TestDownloadMultiThreadedFail(t *testing.T) {
 */
 
 // Checking for expected endpoint results
-func checkEndpointResults(endpoint *url.URL, expChunkType string, expLength int, expCanRange bool, expErr string) error {
-	chunkType, length, canRange, err := getEndpointCapabilities(endpoint)
+func checkEndpointResults(endpoint *url.URL, expChunkType string, expLength int64, expCanRange bool, expErr string) error {
+	caps, err := testClient.getEndpointCapabilities(context.Background(), endpoint)
 	if err != nil && expErr != "" && !strings.Contains(err.Error(), expErr) {
 		return err
 	}
-	if chunkType != expChunkType {
-		return fmt.Errorf("chunkType different for endpoint %v, expected: %s, actual %s", endpoint, expChunkType, chunkType)
+	if caps.ChunkType != expChunkType {
+		return fmt.Errorf("chunkType different for endpoint %v, expected: %s, actual %s", endpoint, expChunkType, caps.ChunkType)
 	}
-	if length != expLength {
-		return fmt.Errorf("length different for endpoint %v, expected: %d, actual %d", endpoint, expLength, length)
+	if caps.Length != expLength {
+		return fmt.Errorf("length different for endpoint %v, expected: %d, actual %d", endpoint, expLength, caps.Length)
 	}
-	if canRange != expCanRange {
-		return fmt.Errorf("canRange different for endpoint %v, expected: %v, actual %v", endpoint, expCanRange, canRange)
+	if caps.CanRange != expCanRange {
+		return fmt.Errorf("canRange different for endpoint %v, expected: %v, actual %v", endpoint, expCanRange, caps.CanRange)
 	}
 	return nil
 }
 
+// In-memory state for a fresh download of the test file
+func newTestState(URL *url.URL) *State {
+	return newState(URL, Capabilities{ChunkType: "bytes", Length: TestFileSize, CanRange: true}, ChunkSize, "")
+}
+
+// The test server as the only mirror of a download
+func testMirrors(URL *url.URL) *mirrorSet {
+	return newMirrorSet(newMirror(URL, "", ""))
+}
+
 // Comparing content
 func compareBytesOffset(a *os.File, b io.Reader, offset int64) error {
 	originalOffset, err := a.Seek(0, io.SeekCurrent)
@@ -244,11 +316,11 @@ func compareBytes(a io.Reader, b io.Reader) error {
 		}
 	}
 	if errA == nil {
-		errors.New(fmt.Sprintf("a has more bytes at offset %d",
+		return errors.New(fmt.Sprintf("a has more bytes at offset %d",
 			processed))
 	}
 	if errB == nil {
-		errors.New(fmt.Sprintf("b has more bytes at offset %d",
+		return errors.New(fmt.Sprintf("b has more bytes at offset %d",
 			processed))
 	}
 	return nil
@@ -306,13 +378,34 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 
 /*
 This function does the following to set up necessary resources for our E2E testing:
-1) Creates a temporary file and fills it with random content
-2) Defines http handlers at the following routes:
-	a) /no-range - does not support range requests, but writes the content of our temporary file to the client
-	b) /success - supports range requests and serves our temporary file properly
-	c) /fail-range - supports range requests, but when client requests a range that includes FailAt,
-	   responds with a 500 internal server error
-3) Starts the http server with the handlers at (2) and listens on localhost:Addr
+ 1. Creates a temporary file and fills it with random content
+ 2. Defines http handlers at the following routes:
+    a) /no-range - does not support range requests, but writes the content of our temporary file to the client
+    b) /success - supports range requests and serves our temporary file properly
+    c) /fail-range - supports range requests, but when client requests a range that includes FailAt,
+    responds with a 500 internal server error
+    The mode query parameter makes it misbehave in other ways instead:
+    ignore - answers every request with 200 OK and the whole file
+    error-page - answers range requests with 200 OK and an html error page
+    wrong-range - sends a range one byte off from the requested one
+    wrong-total - sends the requested range, but claims the file is one byte longer
+    short - sends the right Content-Range, but only half of the bytes
+    d) /slow - like /success, but waits SlowDelay before answering range requests
+    e) /attachment - like /success, but suggests AttachmentName in a Content-Disposition header
+    f) /digest - like /success, but sends the SHA-256 of our temporary file in a Repr-Digest header,
+    or a wrong one if the corrupt query parameter is set
+    g) /changing - like /success, but with an ETag that changes once the number of range requests
+    counted in changingRequests reaches the at query parameter, honouring If-Range
+    h) /busy - like /success, but answers the first range request counted in busyRequests
+    with 503 Service Unavailable and a Retry-After of one second
+    i) /stall - like /success, but the first range request counted in stallRequests
+    stops sending after half of its bytes, until the client gives up
+    j) /trickle - sends ranges at about 10kB/s
+    k) /lag - like /success, but the first range request counted in lagRequests is sent like /trickle
+    l) /corrupt - like /success, but the first range request covering FailAt
+    has that byte flipped
+ 3. Starts the http server with the handlers at (2) and listens on localhost:Addr
+
 It is the responsibility of the caller to clean up the setup by removing the tempfile and closing the server.
 */
 func setupTest() (testFile *os.File, testServer io.Closer, err error) {
@@ -327,6 +420,48 @@ func setupTest() (testFile *os.File, testServer io.Closer, err error) {
 	log.Println("Wrote tempfile contents")
 	mux := http.NewServeMux()
 
+	mux.HandleFunc("/head-forbidden", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "HEAD" {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeFile(writer, request, tmpFile.Name())
+	})
+
+	// Sends more than the HEAD request said the resource holds
+	mux.HandleFunc("/oversized", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "HEAD" {
+			writer.Header().Add("Content-Length", strconv.Itoa(TestFileSize))
+			writer.WriteHeader(200)
+			return
+		}
+		b, err := ioutil.ReadFile(tmpFile.Name())
+		if err != nil {
+			log.Printf("Error reading test file: \n%v\n", err)
+			return
+		}
+		writer.WriteHeader(200)
+		writer.(http.Flusher).Flush()
+		writer.Write(append(b, "extra"...))
+	})
+
+	mux.HandleFunc("/unknown-length", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Add("Accept-Ranges", "bytes")
+		if request.Method == "HEAD" {
+			writer.WriteHeader(200)
+			return
+		}
+		fd, err := os.Open(tmpFile.Name())
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+			return
+		}
+		defer fd.Close()
+		if _, err := io.Copy(writer, fd); err != nil {
+			log.Printf("Error writing to response: \n%v\n", err)
+		}
+	})
+
 	mux.HandleFunc("/no-range", func(writer http.ResponseWriter, request *http.Request) {
 		writer.Header().Add("Content-Length", strconv.Itoa(TestFileSize))
 		if request.Method == "HEAD" {
@@ -358,6 +493,21 @@ func setupTest() (testFile *os.File, testServer io.Closer, err error) {
 	mux.HandleFunc("/fail-range", func(writer http.ResponseWriter, request *http.Request) {
 		fd, err := os.Open(tmpFile.Name())
 		defer fd.Close()
+		mode := request.URL.Query().Get("mode")
+		if request.Method != "HEAD" && (mode == "ignore" || mode == "error-page") {
+			// Answer with 200 OK whether or not a range was asked for
+			if mode == "error-page" && request.Header.Get("Range") != "" {
+				writer.Header().Set("Content-Type", "text/html")
+				_, _ = writer.Write([]byte("<html><body>Something went wrong</body></html>"))
+				return
+			}
+			writer.Header().Set("Content-Length", strconv.Itoa(TestFileSize))
+			_, err = io.Copy(writer, fd)
+			if err != nil {
+				log.Printf("Failed to write to fail-range writer: \n%v\n", err)
+			}
+			return
+		}
 		if request.Method != "HEAD" {
 			requestedRange := request.Header.Get("Range")
 			if len(requestedRange) == 0 {
@@ -378,21 +528,211 @@ func setupTest() (testFile *os.File, testServer io.Closer, err error) {
 				}
 				startEnd[i] = num
 			}
-			if FailAt >= startEnd[0] && FailAt <= startEnd[1] {
-				writer.WriteHeader(500)
-				writer.Write([]byte("Internal server error"))
-			} else {
-				http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+			start, end := startEnd[0], startEnd[1]
+			switch mode {
+			case "wrong-range":
+				writePartialContent(writer, fd, start+1, end+1, TestFileSize, end-start+1)
+			case "wrong-total":
+				writePartialContent(writer, fd, start, end, TestFileSize+1, end-start+1)
+			case "short":
+				writePartialContent(writer, fd, start, end, TestFileSize, (end-start+1)/2)
+			default:
+				if FailAt >= start && FailAt <= end {
+					writer.WriteHeader(500)
+					writer.Write([]byte("Internal server error"))
+				} else {
+					http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+				}
 			}
 		} else {
 			http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
 		}
 	})
+	mux.HandleFunc("/slow", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		if request.Header.Get("Range") != "" {
+			select {
+			case <-time.After(SlowDelay):
+			case <-request.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+	})
+
+	mux.HandleFunc("/attachment", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", AttachmentName))
+		http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+	})
+
+	mux.HandleFunc("/digest", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, fd)
+		if err != nil {
+			log.Printf("Error hashing test file: \n%v\n", err)
+		}
+		sum := h.Sum(nil)
+		if request.URL.Query().Get("corrupt") != "" {
+			sum[0]++
+		}
+		writer.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+		http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+	})
+
+	mux.HandleFunc("/changing", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		at, _ := strconv.ParseInt(request.URL.Query().Get("at"), 10, 64)
+		served := atomic.LoadInt64(&changingRequests)
+		if request.Header.Get("Range") != "" {
+			served = atomic.AddInt64(&changingRequests, 1) - 1
+		}
+		if served < at {
+			writer.Header().Set("ETag", `"v1"`)
+		} else {
+			writer.Header().Set("ETag", `"v2"`)
+		}
+		http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+	})
+
+	mux.HandleFunc("/busy", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		if request.Header.Get("Range") != "" && atomic.AddInt64(&busyRequests, 1) == 1 {
+			writer.Header().Set("Retry-After", "1")
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+	})
+
+	mux.HandleFunc("/stall", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		requestedRange := request.Header.Get("Range")
+		if requestedRange != "" && atomic.AddInt64(&stallRequests, 1) == 1 {
+			var start, end int64
+			fmt.Sscanf(requestedRange, "bytes=%d-%d", &start, &end)
+			writer.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, TestFileSize))
+			writer.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+			writer.WriteHeader(http.StatusPartialContent)
+			io.Copy(writer, io.NewSectionReader(fd, start, (end-start+1)/2))
+			writer.(http.Flusher).Flush()
+			<-request.Context().Done()
+			return
+		}
+		http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+	})
+
+	mux.HandleFunc("/trickle", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		if request.Method == "HEAD" {
+			http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+			return
+		}
+		writeTrickle(writer, request, fd)
+	})
+
+	mux.HandleFunc("/lag", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		if request.Header.Get("Range") != "" && atomic.AddInt64(&lagRequests, 1) == 1 {
+			writeTrickle(writer, request, fd)
+			return
+		}
+		http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+	})
+
+	mux.HandleFunc("/corrupt", func(writer http.ResponseWriter, request *http.Request) {
+		fd, err := os.Open(tmpFile.Name())
+		defer fd.Close()
+		if err != nil {
+			log.Printf("Error opening test file: \n%v\n", err)
+		}
+		var start, end int64
+		fmt.Sscanf(request.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		if request.Header.Get("Range") != "" && start <= FailAt && FailAt <= end && atomic.AddInt64(&corruptRequests, 1) == 1 {
+			body := make([]byte, end-start+1)
+			fd.ReadAt(body, start)
+			body[FailAt-start] ^= 0xff
+			writer.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, TestFileSize))
+			writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			writer.WriteHeader(http.StatusPartialContent)
+			writer.Write(body)
+			return
+		}
+		http.ServeContent(writer, request, tmpFile.Name(), time.Unix(0, 0), fd)
+	})
+
 	testServer, err = ListenAndServeWithClose(Addr, mux)
 	log.Printf("Server listening at %s\n", Addr)
 	return tmpFile, testServer, nil
 }
 
+// Writes a 206 response claiming to hold bytes start-end of total,
+// with a body of the n bytes of f from start onwards
+func writePartialContent(writer http.ResponseWriter, f *os.File, start, end, total, n int64) {
+	writer.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	writer.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	writer.WriteHeader(http.StatusPartialContent)
+	_, err := io.Copy(writer, io.NewSectionReader(f, start, n))
+	if err != nil {
+		log.Printf("Failed to write partial content: \n%v\n", err)
+	}
+}
+
+// Answers a range request for f at about 10kB/s, until the client gives up
+func writeTrickle(writer http.ResponseWriter, request *http.Request, f *os.File) {
+	var start, end int64
+	fmt.Sscanf(request.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+	writer.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, TestFileSize))
+	writer.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	writer.WriteHeader(http.StatusPartialContent)
+	for offset := start; offset <= end; offset += 1000 {
+		n := int64(1000)
+		if offset+n > end+1 {
+			n = end + 1 - offset
+		}
+		io.Copy(writer, io.NewSectionReader(f, offset, n))
+		writer.(http.Flusher).Flush()
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
 // https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go
 func randString(n int) string {
 	const (
@@ -0,0 +1,136 @@
+package download
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrChecksumMismatch is matched by errors.Is for every ChecksumError
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumError reports a completed download whose content does not match an expected checksum
+type ChecksumError struct {
+	Path      string
+	Algorithm string
+	Source    string // Where the expected checksum came from, if known
+	Expected  []byte
+	Actual    []byte
+}
+
+func (e *ChecksumError) Error() string {
+	source := ""
+	if e.Source != "" {
+		source = " (from " + e.Source + ")"
+	}
+	return fmt.Sprintf("%s checksum mismatch for %s%s: expected %s, got %s",
+		e.Algorithm, e.Path, source, hex.EncodeToString(e.Expected), hex.EncodeToString(e.Actual))
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// ErrRangeUnsupported means the endpoint does not honour range requests,
+// so the resource can only be downloaded in a single stream
+var ErrRangeUnsupported = errors.New("endpoint does not support range requests")
+
+// StatusError reports a response with an unexpected HTTP status code
+type StatusError struct {
+	Code       int
+	Status     string        // Status line of the response, e.g. "404 Not Found"
+	RetryAfter time.Duration // How long a 429 or 503 response asked us to wait, if it did
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected status " + e.Status
+}
+
+// Temporary reports whether the server may answer differently later: 408, 429 and 5xx responses
+func (e *StatusError) Temporary() bool {
+	return e.Code == http.StatusRequestTimeout || e.Code == http.StatusTooManyRequests || e.Code >= 500
+}
+
+// ErrResourceChanged means the resource on the server changed while it was being downloaded,
+// so the chunks already written belong to a different version of it
+var ErrResourceChanged = errors.New("resource changed on the server during the download")
+
+// ErrStalled means a transfer was abandoned for receiving data too slowly, or none at all
+var ErrStalled = errors.New("transfer stalled")
+
+// ErrRetriesExhausted is matched by errors.Is for every RetryError
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+// RetryError reports a range given up on after failing too many times, or when the retry budget ran out
+type RetryError struct {
+	Start    int64 // Byte range left to download, End excluded
+	End      int64
+	Attempts int   // Failed attempts at the range
+	Budget   int   // The retry budget that ran out, 0 if the range ran out of attempts
+	Err      error // The last failure
+}
+
+func (e *RetryError) Error() string {
+	if e.Budget > 0 {
+		return fmt.Sprintf("retry budget of %d exhausted downloading range %d to %d, last error: %v", e.Budget, e.Start, e.End, e.Err)
+	}
+	return fmt.Sprintf("too many attempts downloading range %d to %d: %v", e.Start, e.End, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RetryError) Is(target error) bool {
+	return target == ErrRetriesExhausted
+}
+
+// ErrDiskFull is matched by errors.Is when a download could not be written for lack of space
+var ErrDiskFull = errors.New("no space left on device")
+
+// diskFullError marks an error writing to a full disk
+type diskFullError struct {
+	error
+}
+
+func (e diskFullError) Unwrap() error {
+	return e.error
+}
+
+func (e diskFullError) Is(target error) bool {
+	return target == ErrDiskFull
+}
+
+// ErrCancelled is matched by errors.Is when a download stopped because its context was cancelled.
+// It is context.Canceled, a download timing out fails with context.DeadlineExceeded instead
+var ErrCancelled = context.Canceled
+
+// Temporary reports whether a download failing with err may succeed if tried again later:
+// network errors, timeouts, stalled transfers and 408, 429 and 5xx responses are temporary,
+// while e.g. a 404, a checksum mismatch, a full disk or a cancelled download are not
+func Temporary(err error) bool {
+	if errors.Is(err, ErrCancelled) || errors.Is(err, ErrDiskFull) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrResourceChanged) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		// A url.Error is a net.Error whatever it wraps, a malformed URL included
+		if urlErr, ok := netErr.(*url.Error); ok {
+			return urlErr.Timeout() || Temporary(urlErr.Err)
+		}
+		return true
+	}
+	return errors.Is(err, ErrStalled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
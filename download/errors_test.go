@@ -0,0 +1,84 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTemporary(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		temporary bool
+	}{
+		{&StatusError{Code: 404, Status: "404 Not Found"}, false},
+		{&StatusError{Code: 503, Status: "503 Service Unavailable"}, true},
+		{&RetryError{Err: &StatusError{Code: 429, Status: "429 Too Many Requests"}}, true},
+		{&RetryError{Err: &StatusError{Code: 403, Status: "403 Forbidden"}}, false},
+		{&RetryError{Err: fmt.Errorf("reading: %w", io.ErrUnexpectedEOF)}, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: io.ErrUnexpectedEOF}, true},
+		{fmt.Errorf("input line 2: %w", &url.Error{Op: "parse", URL: "out=a", Err: errors.New("invalid URI for request")}), false},
+		{ErrStalled, true},
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("download interrupted: %w", context.Canceled), false},
+		{&ChecksumError{Algorithm: "md5"}, false},
+		{diskFullError{&os.PathError{Op: "write", Path: "a", Err: syscall.ENOSPC}}, false},
+		{ErrResourceChanged, false},
+		{errors.New("invalid output path"), false},
+	} {
+		if Temporary(c.err) != c.temporary {
+			t.Errorf("%v: expected temporary to be %v", c.err, c.temporary)
+		}
+	}
+	if !errors.Is(diskFullError{syscall.ENOSPC}, ErrDiskFull) || !errors.Is(context.Canceled, ErrCancelled) {
+		t.Error("expected the sentinels to match")
+	}
+}
+
+// A missing resource fails with its status before anything is written
+func TestDownloadStatusError(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testClient.Download(context.Background(), Request{URL: url, Dir: dir})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != 404 || Temporary(err) {
+		t.Errorf("expected a 404, got %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) > 0 {
+		t.Errorf("expected nothing to be written, got %v", files)
+	}
+}
+
+// Servers rejecting HEAD requests are downloaded in a single stream
+func TestDownloadHeadRejected(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/head-forbidden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := testClient.Download(context.Background(), Request{URL: url, Dir: dir})
+	if err != nil || res.Bytes != TestFileSize {
+		t.Errorf("expected the download to fall back to a single stream, got %+v %v", res, err)
+	}
+}
@@ -0,0 +1,250 @@
+package download
+
+import (
+	"fmt"
+	"github.com/stephng3/DoubleUp/constants"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is what an Event reports
+type EventType string
+
+const (
+	EventProbed         EventType = "probed"          // The resource was probed, see Event.Capabilities
+	EventStarted        EventType = "started"         // Writing to Event.Path started, Completed of it already downloaded
+	EventChunkStarted   EventType = "chunk_started"   // A connection requested bytes Start to End of URL
+	EventChunkRetried   EventType = "chunk_retried"   // A request for Start to End failed with Err and will be retried
+	EventChunkCompleted EventType = "chunk_completed" // Bytes Start to End were downloaded and verified
+	EventProgress       EventType = "progress"        // Periodic report of the download so far, see Event.Transfers
+	EventMirrorDropped  EventType = "mirror_dropped"  // URL is no longer used, because of Err
+	EventNotice         EventType = "notice"          // Something the user may want to know, see Event.Message
+	EventFinished       EventType = "finished"        // The download completed, see Event.Result
+	EventFailed         EventType = "failed"          // The download failed with Err
+)
+
+// Event reports a step of a download to Request.Events. Completed, Total, Speed and ETA are set on every event,
+// the other fields depending on its Type
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	Completed int64         // Bytes downloaded so far
+	Total     int64         // Size of the resource, 0 if not known
+	Speed     float64       // Bytes/s over the last few seconds
+	ETA       time.Duration // Time left at Speed, 0 if not known
+
+	Capabilities *Capabilities // EventProbed
+	Path         string        // EventStarted, Stdout if streamed
+	Connection   int           // Connection of chunk events, numbered from 0
+	URL          *url.URL      // Where a chunk is requested from, or the mirror dropped
+	Start        int64         // Byte range of chunk events, End excluded
+	End          int64
+	Attempt      int        // Failed attempts at a range so far, for EventChunkStarted and EventChunkRetried
+	Transfers    []Transfer // EventProgress, by connection
+	Message      string     // EventNotice
+	Err          error      // EventChunkRetried, EventMirrorDropped and EventFailed
+	Result       *Result    // EventFinished
+}
+
+// Transfer is a range request in flight, as reported by EventProgress
+type Transfer struct {
+	Connection int
+	URL        *url.URL
+	Start      int64 // Byte range requested, End excluded
+	End        int64
+	Written    int64   // Bytes received so far
+	Speed      float64 // Average bytes/s since the request started
+	Attempt    int     // Failed attempts at the range before this one
+}
+
+// reporter sends the Events of a download to its subscriber, filling in progress, speed and ETA.
+// Its methods do nothing if there is no subscriber, and events are sent one at a time
+type reporter struct {
+	subscriber func(Event)
+
+	mu        sync.Mutex
+	total     int64
+	completed int64        // Bytes of completed chunks, or written so far by a single stream
+	partial   func() int64 // Bytes written past the completed chunks, nil if none
+	last      int64        // Completed as last reported, which never goes down
+	samples   []progressSample
+	lastTick  time.Time
+	transfers map[int]*transfer
+}
+
+type progressSample struct {
+	at        time.Time
+	completed int64
+}
+
+type transfer struct {
+	Transfer
+	began   time.Time
+	written *int64 // Accessed atomically
+}
+
+func newReporter(subscriber func(Event)) *reporter {
+	return &reporter{subscriber: subscriber, transfers: map[int]*transfer{}}
+}
+
+func (r *reporter) active() bool {
+	return r != nil && r.subscriber != nil
+}
+
+// emit sends e to the subscriber
+func (r *reporter) emit(e Event) {
+	if !r.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emitLocked(e)
+}
+
+func (r *reporter) emitLocked(e Event) {
+	e.Time = time.Now()
+	completed := r.completed
+	if r.partial != nil {
+		completed += r.partial()
+	}
+	if r.total > 0 && completed > r.total {
+		completed = r.total
+	}
+	if completed < r.last {
+		completed = r.last
+	}
+	r.last = completed
+	e.Completed, e.Total = completed, r.total
+
+	// Speed over the last few seconds
+	r.samples = append(r.samples, progressSample{e.Time, completed})
+	for len(r.samples) > 2 && e.Time.Sub(r.samples[1].at) > constants.DefaultSpeedWindow {
+		r.samples = r.samples[1:]
+	}
+	if oldest := r.samples[0]; e.Time.Sub(oldest.at) > 0 {
+		e.Speed = float64(completed-oldest.completed) / e.Time.Sub(oldest.at).Seconds()
+	}
+	if e.Speed > 0 && r.total > 0 {
+		e.ETA = time.Duration(float64(r.total-completed) / e.Speed * float64(time.Second))
+	}
+	r.subscriber(e)
+}
+
+// noticef sends an EventNotice
+func (r *reporter) noticef(format string, a ...interface{}) {
+	r.emit(Event{Type: EventNotice, Message: fmt.Sprintf(format, a...)})
+}
+
+// start sets the size of the download and how much of it is already there
+func (r *reporter) start(total int64, completed int64) {
+	if !r.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if total < 0 {
+		total = 0
+	}
+	r.total, r.completed, r.last = total, completed, completed
+	r.samples = nil
+}
+
+// track counts the bytes written past the completed chunks with partial, until it is called with nil
+func (r *reporter) track(partial func() int64) {
+	if !r.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.partial = partial
+}
+
+// add counts n more bytes as completed, sending an EventProgress at most every DefaultProgressInterval
+func (r *reporter) add(n int64) {
+	if !r.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.completed += n
+	if now := time.Now(); now.Sub(r.lastTick) >= constants.DefaultProgressInterval {
+		r.lastTick = now
+		r.emitLocked(Event{Type: EventProgress})
+	}
+}
+
+// chunkCompleted counts the bytes of a completed chunk and sends an EventChunkCompleted
+func (r *reporter) chunkCompleted(start int64, end int64) {
+	if !r.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.completed += end - start
+	r.emitLocked(Event{Type: EventChunkCompleted, Start: start, End: end})
+}
+
+// chunkStarted sends an EventChunkStarted, and reports the transfer in EventProgress until chunkDone.
+// written counts the bytes of the transfer, accessed atomically
+func (r *reporter) chunkStarted(conn int, URL *url.URL, start int64, end int64, attempt int, written *int64) {
+	if !r.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers[conn] = &transfer{
+		Transfer: Transfer{Connection: conn, URL: URL, Start: start, End: end, Attempt: attempt},
+		began:    time.Now(),
+		written:  written,
+	}
+	r.emitLocked(Event{Type: EventChunkStarted, Connection: conn, URL: URL, Start: start, End: end, Attempt: attempt})
+}
+
+// chunkDone stops reporting the transfer of conn
+func (r *reporter) chunkDone(conn int) {
+	if !r.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.transfers, conn)
+}
+
+// tick sends an EventProgress with every transfer in flight
+func (r *reporter) tick() {
+	if !r.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.lastTick = now
+	transfers := make([]Transfer, 0, len(r.transfers))
+	for _, t := range r.transfers {
+		progress := t.Transfer
+		progress.Written = atomic.LoadInt64(t.written)
+		if elapsed := now.Sub(t.began).Seconds(); elapsed > 0 {
+			progress.Speed = float64(progress.Written) / elapsed
+		}
+		transfers = append(transfers, progress)
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].Connection < transfers[j].Connection })
+	r.emitLocked(Event{Type: EventProgress, Transfers: transfers})
+}
+
+// progressWriter counts the bytes of a single stream written through it as completed
+type progressWriter struct {
+	io.Writer
+	reporter *reporter
+}
+
+func (w *progressWriter) Write(b []byte) (n int, err error) {
+	n, err = w.Writer.Write(b)
+	w.reporter.add(int64(n))
+	return
+}
@@ -0,0 +1,169 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HostLimit caps the concurrent requests to every host matching Pattern, a glob such as *.example.com
+type HostLimit struct {
+	Pattern     string
+	Connections int
+}
+
+// ParseHostLimit parses a host limit in <pattern>=<connections> form, e.g. *.example.com=4
+func ParseHostLimit(s string) (HostLimit, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return HostLimit{}, fmt.Errorf("invalid host limit %q, should be <host pattern>=<connections>", s)
+	}
+	pattern := strings.ToLower(strings.TrimSpace(parts[0]))
+	if _, err := path.Match(pattern, ""); err != nil {
+		return HostLimit{}, fmt.Errorf("invalid host pattern %q: %v", pattern, err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || n < 1 {
+		return HostLimit{}, fmt.Errorf("invalid host limit %q, connections should be at least 1", s)
+	}
+	return HostLimit{Pattern: pattern, Connections: n}, nil
+}
+
+// HostLimiter caps the number of concurrent requests to each host across every download of the
+// Clients sharing it: range requests, single stream downloads, the HEAD requests probing the
+// resource and its mirrors, and the files read with Client.Open. Each request in flight takes a connection, idle ones kept for reuse do not.
+// A host gets the limit of the first pattern it matches, or the default limit, 0 meaning no limit.
+// A freed connection goes to the waiting download holding the fewest connections
+// to the host, so that one download cannot starve the others
+type HostLimiter struct {
+	mu           sync.Mutex
+	defaultLimit int
+	limits       []HostLimit
+	hosts        map[string]*hostSlots
+}
+
+// NewHostLimiter returns a HostLimiter allowing defaultLimit connections to hosts that match none of limits
+func NewHostLimiter(defaultLimit int, limits []HostLimit) *HostLimiter {
+	return &HostLimiter{defaultLimit: defaultLimit, limits: limits, hosts: map[string]*hostSlots{}}
+}
+
+// hostSlots are the connections to a single host
+type hostSlots struct {
+	limit   int
+	inUse   int
+	held    map[interface{}]int    // Connections held by each download
+	last    map[interface{}]uint64 // When each download last got a connection, for breaking ties
+	granted uint64
+	waiting []*hostWaiter
+}
+
+type hostWaiter struct {
+	owner interface{}
+	ready chan struct{}
+}
+
+// limit is the connection limit of host, 0 for no limit
+func (l *HostLimiter) limit(host string) int {
+	for _, limit := range l.limits {
+		if ok, _ := path.Match(limit.Pattern, host); ok {
+			return limit.Connections
+		}
+	}
+	return l.defaultLimit
+}
+
+// acquire waits for a connection to host on behalf of owner, the download it is for.
+// The returned release must be called once the connection is no longer used
+func (l *HostLimiter) acquire(ctx context.Context, host string, owner interface{}) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	slots := l.hosts[host]
+	if slots == nil {
+		limit := l.limit(host)
+		if limit < 1 {
+			l.mu.Unlock()
+			return func() {}, nil
+		}
+		slots = &hostSlots{limit: limit, held: map[interface{}]int{}, last: map[interface{}]uint64{}}
+		l.hosts[host] = slots
+	}
+	release = func() { l.release(slots, owner) }
+	if slots.inUse < slots.limit && len(slots.waiting) == 0 {
+		slots.grant(owner)
+		l.mu.Unlock()
+		return release, nil
+	}
+	w := &hostWaiter{owner: owner, ready: make(chan struct{})}
+	slots.waiting = append(slots.waiting, w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, waiter := range slots.waiting {
+			if waiter == w {
+				slots.waiting = append(slots.waiting[:i], slots.waiting[i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+		// Granted just as ctx was cancelled, pass the connection on
+		l.releaseLocked(slots, owner)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *HostLimiter) release(slots *hostSlots, owner interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked(slots, owner)
+}
+
+func (l *HostLimiter) releaseLocked(slots *hostSlots, owner interface{}) {
+	slots.inUse--
+	if slots.held[owner]--; slots.held[owner] == 0 {
+		delete(slots.held, owner)
+		delete(slots.last, owner)
+	}
+	if len(slots.waiting) == 0 {
+		return
+	}
+	// The download holding the fewest connections goes next, the one served longest ago on a tie
+	next := 0
+	for i, w := range slots.waiting[1:] {
+		best := slots.waiting[next]
+		if held, bestHeld := slots.held[w.owner], slots.held[best.owner]; held < bestHeld ||
+			(held == bestHeld && slots.last[w.owner] < slots.last[best.owner]) {
+			next = i + 1
+		}
+	}
+	w := slots.waiting[next]
+	slots.waiting = append(slots.waiting[:next], slots.waiting[next+1:]...)
+	slots.grant(w.owner)
+	close(w.ready)
+}
+
+func (s *hostSlots) grant(owner interface{}) {
+	s.inUse++
+	s.held[owner]++
+	s.granted++
+	s.last[owner] = s.granted
+}
+
+// downloadKey is the context key of the download a request belongs to, for sharing hosts fairly
+type downloadKey struct{}
+
+// acquireHost waits for a connection to the host of URL within the Client's HostLimiter,
+// to be held for as long as the request made on it is in flight
+func (c *Client) acquireHost(ctx context.Context, URL *url.URL) (release func(), err error) {
+	return c.HostLimiter.acquire(ctx, URL.Hostname(), ctx.Value(downloadKey{}))
+}
@@ -0,0 +1,181 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseHostLimit(t *testing.T) {
+	limit, err := ParseHostLimit("*.Example.com=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit.Pattern != "*.example.com" || limit.Connections != 4 {
+		t.Errorf("unexpected limit %+v", limit)
+	}
+	for _, invalid := range []string{"example.com", "example.com=0", "[=2", "example.com=x"} {
+		if _, err := ParseHostLimit(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestHostLimiterCap(t *testing.T) {
+	l := NewHostLimiter(0, []HostLimit{{Pattern: "*.example.com", Connections: 2}})
+	if l.limit("a.example.com") != 2 || l.limit("example.org") != 0 {
+		t.Error("host not matched to its limit")
+	}
+	var inUse, maxInUse int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(owner int) {
+			defer wg.Done()
+			release, err := l.acquire(context.Background(), "A.example.com", owner%2)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt64(&inUse, 1)
+			for {
+				max := atomic.LoadInt64(&maxInUse)
+				if n <= max || atomic.CompareAndSwapInt64(&maxInUse, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&inUse, -1)
+			release()
+		}(i)
+	}
+	wg.Wait()
+	if maxInUse != 2 {
+		t.Errorf("expected at most 2 connections at a time, got %d", maxInUse)
+	}
+}
+
+// A freed connection goes to the download holding the fewest, and waiters can give up
+func TestHostLimiterFairness(t *testing.T) {
+	l := NewHostLimiter(2, nil)
+	ctx := context.Background()
+	releaseA1, _ := l.acquire(ctx, "example.com", "a")
+	releaseA2, _ := l.acquire(ctx, "example.com", "a")
+
+	acquired := make(chan string, 3)
+	wait := func(ctx context.Context, owner string) {
+		if _, err := l.acquire(ctx, "example.com", owner); err == nil {
+			acquired <- owner
+		}
+	}
+	go wait(ctx, "a")
+	time.Sleep(10 * time.Millisecond)
+	cancelled, cancel := context.WithCancel(ctx)
+	go wait(cancelled, "c")
+	time.Sleep(10 * time.Millisecond)
+	go wait(ctx, "b")
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	releaseA1()
+	if owner := <-acquired; owner != "b" {
+		t.Errorf("expected b to get the connection before a, which holds one, got %s", owner)
+	}
+	releaseA2()
+	if owner := <-acquired; owner != "a" {
+		t.Errorf("expected a to get the next connection, got %s", owner)
+	}
+	select {
+	case owner := <-acquired:
+		t.Errorf("cancelled waiter %s got a connection", owner)
+	default:
+	}
+}
+
+// Probing a resource takes a connection to its host like any other request
+func TestHostLimiterProbe(t *testing.T) {
+	opts := testOptions
+	opts.HostLimiter = NewHostLimiter(1, nil)
+	c := NewClient(opts)
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := c.HostLimiter.acquire(context.Background(), url.Hostname(), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.getEndpointCapabilities(ctx, url); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the probe to wait for the host, got %v", err)
+	}
+	release()
+	if _, err := c.getEndpointCapabilities(context.Background(), url); err != nil {
+		t.Error(err)
+	}
+}
+
+// A file read with Open holds a connection to its host until it is closed
+func TestHostLimiterOpen(t *testing.T) {
+	opts := testOptions
+	opts.HostLimiter = NewHostLimiter(1, nil)
+	c := NewClient(opts)
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := c.Open(context.Background(), url.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Open(ctx, url.String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the second read to wait for the host, got %v", err)
+	}
+	body.Close()
+	body.Close()
+	for i := 0; i < 2; i++ {
+		body, err := c.Open(context.Background(), url.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+	}
+	if held := c.HostLimiter.hosts[url.Hostname()].inUse; held != 0 {
+		t.Errorf("expected every connection to be released, %d still held", held)
+	}
+}
+
+// Concurrent downloads sharing a host limiter all complete
+func TestDownloadHostLimit(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := testOptions
+	opts.HostLimiter = NewHostLimiter(2, nil)
+	c := NewClient(opts)
+	var reqs []Request
+	for _, name := range []string{"a", "b", "c"} {
+		url, err := getTestURL("/success")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, Request{URL: url, Output: filepath.Join(dir, name)})
+	}
+	for _, result := range c.DownloadBatch(context.Background(), reqs, 3) {
+		if result.Err != nil {
+			t.Error(result.Err)
+		}
+	}
+}
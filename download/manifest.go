@@ -0,0 +1,130 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PieceManifest describes the pieces of a resource, as read from a sidecar JSON or .zsync file
+type PieceManifest struct {
+	Pieces    *Pieces
+	Size      int64      // Size of the resource, 0 if not given
+	Checksums []Checksum // Whole file checksums, if given
+}
+
+// manifestJSON is the layout of a sidecar JSON manifest, e.g.
+// {"algorithm": "sha256", "pieceLength": 1048576, "length": 5242880, "pieces": ["9f86d081...", ...]}
+type manifestJSON struct {
+	Algorithm   string   `json:"algorithm"`
+	PieceLength int64    `json:"pieceLength"`
+	Length      int64    `json:"length,omitempty"`
+	Pieces      []string `json:"pieces"`
+}
+
+// ParsePieceManifest reads a piece manifest, either a sidecar JSON file or a .zsync file.
+// Only the strong checksums of zsync blocks are used, its rolling checksums are for
+// finding blocks in local files and of no use to verify a download
+func ParsePieceManifest(r io.Reader) (*PieceManifest, error) {
+	br := bufio.NewReader(r)
+	start, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(start) == "zsync:" {
+		return parseZsync(br)
+	}
+	var doc manifestJSON
+	if err := json.NewDecoder(br).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid piece manifest: %v", err)
+	}
+	pieces := &Pieces{Algorithm: strings.ToLower(doc.Algorithm), Length: doc.PieceLength}
+	for i, hexSum := range doc.Pieces {
+		sum, err := hex.DecodeString(hexSum)
+		if err != nil {
+			return nil, fmt.Errorf("invalid piece manifest: piece %d: %v", i, err)
+		}
+		pieces.Sums = append(pieces.Sums, sum)
+	}
+	if len(pieces.Sums) == 0 {
+		return nil, fmt.Errorf("invalid piece manifest: no pieces")
+	}
+	length := doc.Length
+	if length == 0 {
+		// The pieces cover at least all but the last piece
+		length = int64(len(pieces.Sums)-1)*pieces.Length + 1
+	}
+	if err := pieces.validate(length); err != nil {
+		return nil, fmt.Errorf("invalid piece manifest: %v", err)
+	}
+	return &PieceManifest{Pieces: pieces, Size: doc.Length}, nil
+}
+
+// parseZsync reads a .zsync file: "Key: value" headers up to a blank line,
+// then for every block its rolling checksum followed by the first bytes of its MD4,
+// the byte counts given by Hash-Lengths
+func parseZsync(r *bufio.Reader) (*PieceManifest, error) {
+	headers := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid zsync file: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			headers[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	blockSize, err := strconv.ParseInt(headers["blocksize"], 10, 64)
+	if err != nil || blockSize < 1 {
+		return nil, fmt.Errorf("invalid zsync file: bad Blocksize %q", headers["blocksize"])
+	}
+	length, err := strconv.ParseInt(headers["length"], 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid zsync file: bad Length %q", headers["length"])
+	}
+	var seqMatches, rsumBytes, checksumBytes int
+	if _, err := fmt.Sscanf(headers["hash-lengths"], "%d,%d,%d", &seqMatches, &rsumBytes, &checksumBytes); err != nil ||
+		rsumBytes < 1 || rsumBytes > 4 || checksumBytes < 1 || checksumBytes > 16 {
+		return nil, fmt.Errorf("invalid zsync file: bad Hash-Lengths %q", headers["hash-lengths"])
+	}
+
+	manifest := &PieceManifest{
+		Pieces: &Pieces{Algorithm: "md4", Length: blockSize, Padded: true},
+		Size:   length,
+	}
+	if sha1 := headers["sha-1"]; sha1 != "" {
+		checksum, err := newChecksum("sha1", sha1)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zsync file: %v", err)
+		}
+		checksum.Source = "zsync file"
+		manifest.Checksums = append(manifest.Checksums, checksum)
+	}
+	block := make([]byte, rsumBytes+checksumBytes)
+	for n := (length + blockSize - 1) / blockSize; n > 0; n-- {
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, fmt.Errorf("invalid zsync file: block checksums: %v", err)
+		}
+		manifest.Pieces.Sums = append(manifest.Pieces.Sums, append([]byte(nil), block[rsumBytes:]...))
+	}
+	return manifest, nil
+}
+
+// LoadPieceManifest reads a piece manifest from a local path or an http(s) URL
+func (c *Client) LoadPieceManifest(ctx context.Context, source string) (*PieceManifest, error) {
+	r, err := c.Open(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ParsePieceManifest(r)
+}
@@ -0,0 +1,128 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/md4"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// zsync file of the test file served by the test server, with the given block size
+func testFileZsync(blockSize int64) ([]byte, error) {
+	b, err := ioutil.ReadFile(testFileName)
+	if err != nil {
+		return nil, err
+	}
+	var zsync bytes.Buffer
+	fmt.Fprintf(&zsync, "zsync: 0.6.2\nFilename: success\nBlocksize: %d\nLength: %d\nHash-Lengths: 2,2,5\n\n", blockSize, len(b))
+	for start := int64(0); start < int64(len(b)); start += blockSize {
+		block := make([]byte, blockSize)
+		copy(block, b[start:])
+		sum := md4.New()
+		sum.Write(block)
+		zsync.Write([]byte{0, 0})
+		zsync.Write(sum.Sum(nil)[:5])
+	}
+	return zsync.Bytes(), nil
+}
+
+func TestParsePieceManifest(t *testing.T) {
+	manifest, err := ParsePieceManifest(strings.NewReader(`{"algorithm": "SHA256", "pieceLength": 4, "length": 6,
+		"pieces": ["` + strings.Repeat("00", 32) + `", "` + strings.Repeat("11", 32) + `"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Size != 6 || manifest.Pieces.Algorithm != "sha256" || len(manifest.Pieces.Sums) != 2 {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	for _, invalid := range []string{
+		`{"algorithm": "sha256", "pieceLength": 4, "length": 10, "pieces": ["` + strings.Repeat("00", 32) + `"]}`,
+		`{"algorithm": "sha256", "pieceLength": 4, "pieces": ["zz"], "length": 4}`,
+		`{"algorithm": "crc32", "pieceLength": 4, "pieces": ["00000000"]}`,
+		`{"algorithm": "sha256", "pieceLength": 4, "pieces": []}`,
+		"zsync: 0.6.2\nBlocksize: 2048\nLength: 4096\nHash-Lengths: 2,2,5\n\n\x00\x00",
+	} {
+		if _, err := ParsePieceManifest(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+
+	zsync, err := testFileZsync(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err = ParsePieceManifest(bytes.NewReader(zsync))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Size != TestFileSize || manifest.Pieces.Length != 2048 || !manifest.Pieces.Padded || len(manifest.Pieces.Sums[0]) != 5 {
+		t.Errorf("unexpected zsync manifest %+v", manifest.Pieces)
+	}
+}
+
+func TestPieceChunkSize(t *testing.T) {
+	for _, c := range []struct{ chunkSize, pieceLength, expected int64 }{
+		{64000, 2048, 65536},
+		{65536, 2048, 65536},
+		{64000, 1 << 20, 1 << 20},
+	} {
+		if got := pieceChunkSize(c.chunkSize, c.pieceLength); got != c.expected {
+			t.Errorf("pieceChunkSize(%d, %d): expected %d, got %d", c.chunkSize, c.pieceLength, c.expected, got)
+		}
+	}
+}
+
+// Chunks of many zsync blocks are verified block by block, padding the last block
+func TestDownloadZsync(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zsync, err := testFileZsync(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := dir + "/success.zsync"
+	if err := ioutil.WriteFile(manifestPath, zsync, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := testClient.LoadPieceManifest(context.Background(), manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := getTestURL("/corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt64(&corruptRequests, 0)
+	_, err = testClient.Download(context.Background(), Request{URL: url, Dir: dir, Pieces: manifest.Pieces, Size: manifest.Size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&corruptRequests); n < 2 {
+		t.Errorf("expected the corrupted block to be fetched again, got %d requests for it", n)
+	}
+	expected, err := testFileChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFile(dir+"/corrupt", []Checksum{expected}); err != nil {
+		t.Error(err)
+	}
+
+	// A piece that keeps failing uses up the attempts of its chunk
+	manifest.Pieces.Sums[len(manifest.Pieces.Sums)-1], _ = hex.DecodeString("0000000000")
+	_, err = testClient.Download(context.Background(), Request{URL: url, Output: dir + "/bad", Pieces: manifest.Pieces})
+	if !strings.Contains(fmt.Sprint(err), "too many attempts") {
+		t.Errorf("expected the attempts to run out, got %v", err)
+	}
+}
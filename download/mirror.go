@@ -0,0 +1,179 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"github.com/stephng3/DoubleUp/constants"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirror is one of the URLs a resource is downloaded from, with its record so far
+type mirror struct {
+	URL *url.URL
+	// Validators of the version of the resource on this mirror
+	etag         string
+	lastModified string
+
+	inFlight    int
+	bytes       int64
+	busy        time.Duration // Time spent on requests, for the throughput of a connection to the mirror
+	requests    int
+	failures    int
+	consecutive int // Failures since the last success
+	dropped     bool
+}
+
+func newMirror(URL *url.URL, etag string, lastModified string) *mirror {
+	return &mirror{URL: URL, etag: etag, lastModified: lastModified}
+}
+
+// rate is the throughput of a connection to m in bytes/s, 0 if not known yet
+func (m *mirror) rate() float64 {
+	if m.busy <= 0 {
+		return 0
+	}
+	return float64(m.bytes) / m.busy.Seconds()
+}
+
+// MirrorStats reports how a mirror fared in a download
+type MirrorStats struct {
+	URL        string
+	Bytes      int64 // Bytes downloaded from the mirror
+	Requests   int
+	Failures   int
+	Throughput int64 // Bytes/s of a single connection to the mirror
+	Dropped    bool  // Whether the mirror was given up on
+}
+
+// mirrorSet spreads the requests of a download across mirrors, sending each to the mirror
+// expected to finish it first given its throughput so far and the requests already sent to it.
+// Mirrors that keep failing are deprioritised, and dropped after MirrorMaxFailures in a row,
+// as long as another mirror is left
+type mirrorSet struct {
+	mu      sync.Mutex
+	mirrors []*mirror
+}
+
+func newMirrorSet(mirrors ...*mirror) *mirrorSet {
+	return &mirrorSet{mirrors: mirrors}
+}
+
+// pick chooses the mirror for the next request and counts the request as in flight on it
+func (s *mirrorSet) pick() *mirror {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Mirrors without a throughput yet are assumed to be as fast as the fastest one
+	best := 1.0
+	for _, m := range s.mirrors {
+		if rate := m.rate(); rate > best {
+			best = rate
+		}
+	}
+	var picked *mirror
+	var pickedScore float64
+	for _, m := range s.mirrors {
+		if m.dropped {
+			continue
+		}
+		rate := m.rate()
+		if rate == 0 {
+			rate = best
+		}
+		// Expected time to finish, as a multiple of the time a request takes
+		score := float64(m.inFlight+1) / rate * float64(1+m.consecutive)
+		if picked == nil || score < pickedScore {
+			picked, pickedScore = m, score
+		}
+	}
+	picked.inFlight++
+	picked.requests++
+	return picked
+}
+
+// finish records the outcome of a request to m which transferred n bytes in elapsed.
+// It reports whether m was dropped for failing too often
+func (s *mirrorSet) finish(m *mirror, n int64, elapsed time.Duration, failed bool) (dropped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.inFlight--
+	m.bytes += n
+	m.busy += elapsed
+	if !failed {
+		m.consecutive = 0
+		return false
+	}
+	m.failures++
+	m.consecutive++
+	if m.consecutive >= constants.MirrorMaxFailures {
+		return s.dropLocked(m)
+	}
+	return false
+}
+
+// drop gives up on m, unless it is the last mirror left. It reports whether m was dropped
+func (s *mirrorSet) drop(m *mirror) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropLocked(m)
+}
+
+func (s *mirrorSet) dropLocked(m *mirror) bool {
+	if m.dropped {
+		return true
+	}
+	for _, other := range s.mirrors {
+		if other != m && !other.dropped {
+			m.dropped = true
+			return true
+		}
+	}
+	return false
+}
+
+// stats reports on every mirror, nil if there were none
+func (s *mirrorSet) stats() []MirrorStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]MirrorStats, len(s.mirrors))
+	for i, m := range s.mirrors {
+		stats[i] = MirrorStats{
+			URL:        m.URL.String(),
+			Bytes:      m.bytes,
+			Requests:   m.requests,
+			Failures:   m.failures,
+			Throughput: int64(m.rate()),
+			Dropped:    m.dropped,
+		}
+	}
+	return stats
+}
+
+// probeMirrors checks every mirror with a HEAD request, keeping those that serve the same
+// resource as the primary (same length, and the same ETag if both send one from the same host)
+// with range support. ETags are opaque to each server, mirrors on other hosts are left to the
+// checksum or piece verification instead. The mirrors returned start with the primary
+func (c *Client) probeMirrors(ctx context.Context, r *reporter, primary *mirror, caps Capabilities, URLs []*url.URL) *mirrorSet {
+	set := newMirrorSet(primary)
+	for _, URL := range URLs {
+		mirrorCaps, err := c.getEndpointCapabilities(ctx, URL)
+		if err == nil && mirrorCaps.Length != caps.Length {
+			err = fmt.Errorf("length %d differs from %d", mirrorCaps.Length, caps.Length)
+		}
+		sameHost := strings.EqualFold(URL.Host, primary.URL.Host)
+		if err == nil && sameHost && mirrorCaps.ETag != "" && caps.ETag != "" && mirrorCaps.ETag != caps.ETag {
+			err = fmt.Errorf("ETag %s differs from %s", mirrorCaps.ETag, caps.ETag)
+		}
+		if err != nil {
+			r.emit(Event{Type: EventMirrorDropped, URL: URL, Err: err})
+			continue
+		}
+		set.mirrors = append(set.mirrors, newMirror(URL, mirrorCaps.ETag, mirrorCaps.LastModified))
+	}
+	return set
+}
@@ -0,0 +1,135 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"github.com/stephng3/DoubleUp/constants"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+  Tests for multi-mirror downloads
+*/
+
+func TestMirrorSetPick(t *testing.T) {
+	fast, slow := newMirror(&url.URL{Host: "fast"}, "", ""), newMirror(&url.URL{Host: "slow"}, "", "")
+	set := newMirrorSet(fast, slow)
+	// Requests are spread evenly until there is a throughput to go by
+	if first, second := set.pick(), set.pick(); first == second {
+		t.Errorf("both requests sent to %s", first.URL.Host)
+	}
+	set.finish(fast, 4000, time.Second, false)
+	set.finish(slow, 1000, time.Second, false)
+	picked := map[*mirror]int{}
+	for i := 0; i < 5; i++ {
+		picked[set.pick()]++
+	}
+	if picked[fast] != 4 || picked[slow] != 1 {
+		t.Errorf("expected 4 requests to the fast mirror and 1 to the slow one, got %d and %d", picked[fast], picked[slow])
+	}
+}
+
+func TestMirrorSetDrop(t *testing.T) {
+	good, bad := newMirror(&url.URL{Host: "good"}, "", ""), newMirror(&url.URL{Host: "bad"}, "", "")
+	set := newMirrorSet(good, bad)
+	for i := 1; i <= constants.MirrorMaxFailures; i++ {
+		if dropped := set.finish(bad, 0, time.Millisecond, true); dropped != (i == constants.MirrorMaxFailures) {
+			t.Errorf("failure %d: dropped %v", i, dropped)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if m := set.pick(); m != good {
+			t.Errorf("request sent to dropped mirror %s", m.URL.Host)
+		}
+	}
+	// The last mirror left is never dropped
+	if set.drop(good) {
+		t.Error("dropped the last mirror")
+	}
+	stats := set.stats()
+	if len(stats) != 2 || stats[0].Dropped || !stats[1].Dropped || stats[1].Failures != constants.MirrorMaxFailures {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// A download is spread across the mirrors serving the same resource,
+// leaving out those that cannot serve ranges of it
+func TestDownloadMirrors(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var URLs []*url.URL
+	for _, path := range []string{"/success", "/attachment", "/fail-range?mode=error-page", "/no-range"} {
+		URL, err := getTestURL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		URLs = append(URLs, URL)
+	}
+	res, err := testClient.Download(context.Background(), Request{URL: URLs[0], Mirrors: URLs[1:], Output: "mirrored", Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloadedFile(t, res.Path)
+	if len(res.Mirrors) != 3 {
+		t.Fatalf("expected /no-range to be left out, got %+v", res.Mirrors)
+	}
+	if res.Mirrors[0].Bytes+res.Mirrors[1].Bytes < TestFileSize || res.Mirrors[1].Bytes == 0 {
+		t.Errorf("expected the download to be spread across the first two mirrors, got %+v", res.Mirrors)
+	}
+	if !res.Mirrors[2].Dropped {
+		t.Errorf("expected the mirror ignoring ranges to be dropped, got %+v", res.Mirrors[2])
+	}
+}
+
+// Mirrors on other hosts have ETags of their own, only one of the same host has to match
+func TestProbeMirrorsETag(t *testing.T) {
+	content, err := ioutil.ReadFile(testFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(etags map[string]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etags[r.URL.Path])
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}))
+	}
+	primary := serve(map[string]string{"/file": `"a"`, "/other": `"c"`})
+	defer primary.Close()
+	other := serve(map[string]string{"/file": `"b"`})
+	defer other.Close()
+	primaryURL, _ := url.Parse(primary.URL + "/file")
+	sameHost, _ := url.Parse(primary.URL + "/other")
+	otherHost, _ := url.Parse(other.URL + "/file")
+
+	caps, err := testClient.getEndpointCapabilities(context.Background(), primaryURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := testClient.probeMirrors(context.Background(), newReporter(nil), newMirror(primaryURL, caps.ETag, caps.LastModified), caps, []*url.URL{otherHost, sameHost})
+	if len(set.mirrors) != 2 || set.mirrors[1].URL != otherHost {
+		t.Fatalf("expected only the mirror on another host to be kept, got %+v", set.mirrors)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	res, err := testClient.Download(context.Background(), Request{URL: primaryURL, Mirrors: []*url.URL{otherHost}, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloadedFile(t, res.Path)
+	if len(res.Mirrors) != 2 || res.Mirrors[1].Bytes == 0 {
+		t.Errorf("expected the download to be spread across both hosts, got %+v", res.Mirrors)
+	}
+}
@@ -0,0 +1,144 @@
+package download
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Stdout is the output path that streams the download to standard output
+const Stdout = "-"
+
+// ClobberPolicy decides what happens when the output file already exists
+type ClobberPolicy int
+
+const (
+	Overwrite  ClobberPolicy = iota // Replace the existing file
+	NoClobber                       // Fail the download, leaving the existing file alone
+	AutoRename                      // Save to the first free <name>.1, <name>.2, ...
+)
+
+// Name used when neither the server nor the URL suggest one
+const defaultName = "index.html"
+
+// filenameFromDisposition extracts the filename suggested by a Content-Disposition header,
+// or an empty string if there is none or it is unsafe to use as is
+func filenameFromDisposition(disposition string) string {
+	if disposition == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		return ""
+	}
+	return sanitizeFilename(params["filename"])
+}
+
+// sanitizeFilename strips any directories from a name the server gave us,
+// so that a download can never be written outside the output directory
+func sanitizeFilename(name string) string {
+	name = filepath.Base(filepath.FromSlash(strings.Replace(name, `\`, "/", -1)))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return ""
+	}
+	return name
+}
+
+// defaultFilename picks a name for the downloaded resource when none was given,
+// preferring the server's Content-Disposition over the last segment of the URL path
+func defaultFilename(URL *url.URL, caps Capabilities) string {
+	if caps.Filename != "" {
+		return caps.Filename
+	}
+	if name := sanitizeFilename(path.Base(URL.Path)); name != "" {
+		return name
+	}
+	return defaultName
+}
+
+// outputPath resolves where req should be saved, before the clobber policy is applied
+func outputPath(req Request, caps Capabilities) string {
+	name := req.Output
+	if name == "" {
+		name = defaultFilename(req.URL, caps)
+	}
+	if req.Dir != "" && !filepath.IsAbs(name) {
+		name = filepath.Join(req.Dir, name)
+	}
+	return name
+}
+
+// applyClobberPolicy returns the path to save to when name might already exist.
+// Paths for which taken is true are being written by another download, and are never shared
+func applyClobberPolicy(name string, policy ClobberPolicy, taken func(path string) bool) (string, error) {
+	if taken(name) {
+		if policy != AutoRename {
+			return "", fmt.Errorf("%s is being written by another download", name)
+		}
+	} else if _, err := os.Stat(name); os.IsNotExist(err) {
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+	switch policy {
+	case NoClobber:
+		return "", &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	case AutoRename:
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s.%d", name, i)
+			if taken(candidate) {
+				continue
+			}
+			if _, err := os.Stat(candidate); os.IsNotExist(err) {
+				return candidate, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+	default:
+		return name, nil
+	}
+}
+
+// outputs are the paths the downloads of a Client are writing to,
+// so that concurrent downloads resolving to the same path do not write into one file
+type outputs struct {
+	mu    sync.Mutex
+	paths map[string]interface{} // Download writing to each absolute path
+}
+
+// reserve picks the path for download to save name to under policy, holding it until release is called.
+// A download can reserve a path it holds already, e.g. to start over in it
+func (o *outputs) reserve(name string, policy ClobberPolicy, download interface{}) (path string, release func(), err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	taken := func(path string) bool {
+		holder, ok := o.paths[absPath(path)]
+		return ok && holder != download
+	}
+	if path, err = applyClobberPolicy(name, policy, taken); err != nil {
+		return "", nil, err
+	}
+	key := absPath(path)
+	o.paths[key] = download
+	return path, func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if o.paths[key] == download {
+			delete(o.paths, key)
+		}
+	}, nil
+}
+
+// absPath is path made absolute, or cleaned if that fails
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
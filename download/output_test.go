@@ -0,0 +1,110 @@
+package download
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+  Tests for choosing the output path
+*/
+
+func TestDefaultFilename(t *testing.T) {
+	filenameTests := []struct {
+		url         string
+		disposition string
+		expected    string
+	}{
+		{"http://example.com/files/report.pdf", "", "report.pdf"},
+		{"http://example.com/files/my%20report.pdf?x=1", "", "my report.pdf"},
+		{"http://example.com/", "", defaultName},
+		{"http://example.com", "", defaultName},
+		{"http://example.com/download?id=3", `attachment; filename="data.csv"`, "data.csv"},
+		{"http://example.com/download", `attachment; filename*=UTF-8''na%C3%AFve.txt`, "naïve.txt"},
+		{"http://example.com/download", `attachment; filename="../../etc/passwd"`, "passwd"},
+		{"http://example.com/download", `attachment; filename="..\\evil.exe"`, "evil.exe"},
+		{"http://example.com/download", `attachment; filename=".."`, "download"},
+	}
+	for _, test := range filenameTests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caps := Capabilities{Filename: filenameFromDisposition(test.disposition)}
+		if name := defaultFilename(u, caps); name != test.expected {
+			t.Errorf("filename for %s (%s): expected %q, got %q", test.url, test.disposition, test.expected, name)
+		}
+	}
+}
+
+func TestGetEndpointCapabilitiesFilename(t *testing.T) {
+	url, err := getTestURL("/attachment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps, err := testClient.getEndpointCapabilities(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Filename != AttachmentName {
+		t.Errorf("expected filename %q, got %q", AttachmentName, caps.Filename)
+	}
+}
+
+func TestDownloadClobberPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := Request{URL: url, Dir: filepath.Join(dir, "nested")}
+
+	res, err := testClient.Download(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(dir, "nested", "success"); res.Path != expected {
+		t.Errorf("expected download saved to %s, got %s", expected, res.Path)
+	}
+	checkDownloadedFile(t, res.Path)
+
+	req.Clobber = NoClobber
+	if _, err := testClient.Download(context.Background(), req); !os.IsExist(err) {
+		t.Errorf("expected file exists error, got %v", err)
+	}
+
+	req.Clobber = AutoRename
+	res, err = testClient.Download(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(dir, "nested", "success.1"); res.Path != expected {
+		t.Errorf("expected download saved to %s, got %s", expected, res.Path)
+	}
+	checkDownloadedFile(t, res.Path)
+}
+
+// Checking a downloaded file against the test file
+func checkDownloadedFile(t *testing.T, path string) {
+	testFile, err := os.Open(testFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testFile.Close()
+	downloaded, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloaded.Close()
+	if err := compareBytes(testFile, downloaded); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,183 @@
+package download
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/md4"
+	"hash"
+	"io"
+)
+
+// Pieces are the expected digests of consecutive Length byte pieces of a resource,
+// the last one possibly shorter. A download with pieces is split into chunks of whole pieces,
+// and every piece is verified as it is written and fetched again if it does not match
+type Pieces struct {
+	Algorithm string // One of the algorithms of Checksum, or md4 for zsync
+	Length    int64
+	// Sums may be cut short to the first bytes of each digest, as zsync does
+	Sums [][]byte
+	// Padded pieces are hashed as if the last one were padded with zeros to Length, as zsync does
+	Padded bool
+}
+
+// newPieceHash returns a hash computing the algorithm of pieces.
+// On top of the Checksum algorithms, pieces can be MD4 for zsync, which is no good for whole files
+func newPieceHash(algorithm string) (hash.Hash, error) {
+	if algorithm == "md4" {
+		return md4.New(), nil
+	}
+	return newHash(algorithm)
+}
+
+// validate checks the pieces cover a resource of the given length, with digests of the right size
+func (p *Pieces) validate(length int64) error {
+	h, err := newPieceHash(p.Algorithm)
+	if err != nil {
+		return err
+	}
+	if p.Length < 1 {
+		return fmt.Errorf("invalid piece length %d", p.Length)
+	}
+	if n := (length + p.Length - 1) / p.Length; int64(len(p.Sums)) != n {
+		return fmt.Errorf("%d piece checksums given for %d pieces of %d bytes", len(p.Sums), n, p.Length)
+	}
+	for i, sum := range p.Sums {
+		if len(sum) < 1 || len(sum) > h.Size() {
+			return fmt.Errorf("invalid %s checksum for piece %d: expected up to %d hex digits", p.Algorithm, i, 2*h.Size())
+		}
+	}
+	return nil
+}
+
+// pieceChunkSize rounds chunkSize up to whole pieces
+func pieceChunkSize(chunkSize int64, pieceLength int64) int64 {
+	if chunkSize < pieceLength {
+		return pieceLength
+	}
+	return (chunkSize + pieceLength - 1) / pieceLength * pieceLength
+}
+
+// ErrPieceMismatch is matched by errors.Is for every PieceError
+var ErrPieceMismatch = errors.New("piece checksum mismatch")
+
+// PieceError reports a piece whose content does not match its expected checksum
+type PieceError struct {
+	Index      int64
+	Start, End int64 // Byte range of the piece, End exclusive
+	Algorithm  string
+	Expected   []byte
+	Actual     []byte
+}
+
+func (e *PieceError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch for piece %d (bytes %d-%d): expected %s, got %s",
+		e.Algorithm, e.Index, e.Start, e.End-1, hex.EncodeToString(e.Expected), hex.EncodeToString(e.Actual))
+}
+
+func (e *PieceError) Is(target error) bool {
+	return target == ErrPieceMismatch
+}
+
+// pieceHasher hashes the body of a single range request, which starts at the beginning of a piece
+// and runs on in order, checking every piece as soon as its last byte is written
+type pieceHasher struct {
+	pieces *Pieces
+	length int64 // Length of the resource
+	h      hash.Hash
+	index  int64 // Piece being hashed
+	start  int64
+	end    int64
+}
+
+func newPieceHasher(pieces *Pieces, length int64) *pieceHasher {
+	return &pieceHasher{pieces: pieces, length: length, index: -1}
+}
+
+// write hashes b, written at off. It returns the offset up to which the pieces are verified,
+// with a PieceError if one of the pieces completed by b does not match
+func (p *pieceHasher) write(b []byte, off int64) (verified int64, err error) {
+	if p.index < 0 {
+		p.index = off / p.pieces.Length
+		p.start, p.end = p.pieceRange(p.index)
+		if p.h, err = newPieceHash(p.pieces.Algorithm); err != nil {
+			return p.start, err
+		}
+	}
+	for len(b) > 0 {
+		// There are no pieces past the end of the resource to check the bytes against
+		if off >= p.length {
+			return p.start, fmt.Errorf("received more than the %d bytes of the resource the pieces describe", p.length)
+		}
+		n := int64(len(b))
+		if n > p.end-off {
+			n = p.end - off
+		}
+		p.h.Write(b[:n])
+		b, off = b[n:], off+n
+		if off < p.end {
+			break
+		}
+		if p.pieces.Padded {
+			p.h.Write(make([]byte, p.pieces.Length-(p.end-p.start)))
+		}
+		expected := p.pieces.Sums[p.index]
+		if sum := p.h.Sum(nil); !bytes.Equal(sum[:len(expected)], expected) {
+			return p.start, &PieceError{
+				Index:     p.index,
+				Start:     p.start,
+				End:       p.end,
+				Algorithm: p.pieces.Algorithm,
+				Expected:  expected,
+				Actual:    sum[:len(expected)],
+			}
+		}
+		p.index++
+		p.start, p.end = p.pieceRange(p.index)
+		p.h.Reset()
+	}
+	return p.start, nil
+}
+
+func (p *pieceHasher) pieceRange(i int64) (start int64, end int64) {
+	start, end = i*p.pieces.Length, (i+1)*p.pieces.Length
+	if start > p.length {
+		start = p.length
+	}
+	if end > p.length {
+		end = p.length
+	}
+	return
+}
+
+// pieceWriter verifies the pieces of a resource written to it in a single stream from its start.
+// A piece that does not match cannot be fetched again on its own, so it fails the stream
+type pieceWriter struct {
+	io.Writer
+	hasher   *pieceHasher
+	written  int64
+	verified int64
+}
+
+func newPieceWriter(w io.Writer, pieces *Pieces, length int64) *pieceWriter {
+	return &pieceWriter{Writer: w, hasher: newPieceHasher(pieces, length)}
+}
+
+func (w *pieceWriter) Write(b []byte) (n int, err error) {
+	n, err = w.Writer.Write(b)
+	verified, hashErr := w.hasher.write(b[:n], w.written)
+	w.written, w.verified = w.written+int64(n), verified
+	if hashErr != nil {
+		return n, hashErr
+	}
+	return
+}
+
+// check reports whether every piece was written and verified
+func (w *pieceWriter) check() error {
+	if w.verified != w.hasher.length {
+		return fmt.Errorf("only %d of %d bytes could be verified against the piece checksums", w.verified, w.hasher.length)
+	}
+	return nil
+}
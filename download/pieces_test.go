@@ -0,0 +1,160 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// Pieces of the test file served by the test server
+func testFilePieces(length int64) (*Pieces, error) {
+	b, err := ioutil.ReadFile(testFileName)
+	if err != nil {
+		return nil, err
+	}
+	pieces := &Pieces{Algorithm: "sha256", Length: length}
+	for start := int64(0); start < int64(len(b)); start += length {
+		end := start + length
+		if end > int64(len(b)) {
+			end = int64(len(b))
+		}
+		sum := sha256.Sum256(b[start:end])
+		pieces.Sums = append(pieces.Sums, sum[:])
+	}
+	return pieces, nil
+}
+
+func TestPieceHasher(t *testing.T) {
+	b := []byte("0123456789")
+	pieces := &Pieces{Algorithm: "sha256", Length: 4}
+	for _, piece := range [][]byte{b[0:4], b[4:8], b[8:]} {
+		sum := sha256.Sum256(piece)
+		pieces.Sums = append(pieces.Sums, sum[:])
+	}
+	if err := pieces.validate(int64(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pieces.validate(int64(len(b)) + 4); err == nil {
+		t.Error("expected too few pieces to be rejected")
+	}
+
+	// Writes starting at a piece are verified as each piece completes
+	h := newPieceHasher(pieces, int64(len(b)))
+	for _, write := range []struct {
+		off, end, verified int64
+	}{{4, 6, 4}, {6, 9, 8}, {9, 10, 10}} {
+		verified, err := h.write(b[write.off:write.end], write.off)
+		if err != nil || verified != write.verified {
+			t.Errorf("write %d-%d: expected verified up to %d, got %d, %v", write.off, write.end, write.verified, verified, err)
+		}
+	}
+
+	// Bytes past the last piece are an error, not a piece of their own
+	h = newPieceHasher(pieces, int64(len(b)))
+	if verified, err := h.write(append(b, 'x'), 0); err == nil || verified != 10 {
+		t.Errorf("expected the extra byte to be rejected with 10 bytes verified, got %d, %v", verified, err)
+	}
+
+	// A corrupted piece stops verification at its start
+	corrupt := append([]byte(nil), b...)
+	corrupt[5] = 'x'
+	h = newPieceHasher(pieces, int64(len(b)))
+	verified, err := h.write(corrupt, 0)
+	var pieceErr *PieceError
+	if !errors.As(err, &pieceErr) || pieceErr.Index != 1 || verified != 4 {
+		t.Errorf("expected piece 1 to mismatch with 4 bytes verified, got %d, %v", verified, err)
+	}
+}
+
+// A corrupted piece is fetched again, and a download whose pieces never match fails
+func TestDownloadPieces(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := testFilePieces(3 * ChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt64(&corruptRequests, 0)
+	res, err := testClient.Download(context.Background(), Request{URL: url, Dir: dir, Pieces: pieces, Size: TestFileSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&corruptRequests); n < 2 {
+		t.Errorf("expected the corrupted piece to be fetched again, got %d requests for it", n)
+	}
+	f, err := os.Open(res.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	expected, err := os.Open(testFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expected.Close()
+	if err := compareBytesAll(f, expected); err != nil {
+		t.Error(err)
+	}
+
+	pieces.Sums[0] = make([]byte, sha256.Size)
+	_, err = testClient.Download(context.Background(), Request{URL: url, Output: filepath.Join(dir, "bad"), Pieces: pieces})
+	if !errors.Is(err, ErrPieceMismatch) {
+		t.Errorf("expected piece mismatch, got %v", err)
+	}
+
+	_, err = testClient.Download(context.Background(), Request{URL: url, Output: filepath.Join(dir, "short"), Size: TestFileSize + 1})
+	if err == nil {
+		t.Error("expected a size mismatch to fail")
+	}
+}
+
+// Without range requests the pieces are verified in the single stream, failing it on a mismatch
+func TestDownloadPiecesSingleStream(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/no-range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := testFilePieces(3 * ChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := testClient.Download(context.Background(), Request{URL: url, Dir: dir, Pieces: pieces})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloadedFile(t, res.Path)
+
+	// Bytes past the length the pieces describe fail the download
+	oversized, err := getTestURL("/oversized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testClient.Download(context.Background(), Request{URL: oversized, Output: filepath.Join(dir, "oversized"), Pieces: pieces})
+	if err == nil {
+		t.Error("expected a body longer than the resource to fail")
+	}
+
+	pieces.Sums[1] = make([]byte, sha256.Size)
+	_, err = testClient.Download(context.Background(), Request{URL: url, Output: filepath.Join(dir, "bad"), Pieces: pieces})
+	if !errors.Is(err, ErrPieceMismatch) {
+		t.Errorf("expected piece mismatch, got %v", err)
+	}
+}
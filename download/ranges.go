@@ -0,0 +1,100 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rangeHeader builds the Range header requesting chunk
+// HTTP ranges include their last byte, whereas chunk.end is one past it
+func rangeHeader(chunk Chunk) string {
+	return chunk.chunkType + "=" + strconv.FormatInt(chunk.start, 10) + "-" + strconv.FormatInt(chunk.end-1, 10)
+}
+
+// ifRangeHeader picks the validator to send in If-Range, so that a chunk is only served
+// from the same version of the resource as the others. Weak ETags cannot be used in If-Range,
+// in which case the Last-Modified date is used if there is one
+func ifRangeHeader(etag string, lastModified string) string {
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return lastModified
+}
+
+// changedValidator reports how res shows the resource differs from the version described by
+// etag and lastModified, or an empty string if it does not
+func changedValidator(res *http.Response, etag string, lastModified string) string {
+	if got := res.Header.Get("ETag"); etag != "" && got != "" && got != etag {
+		return fmt.Sprintf("ETag was %s, now %s", etag, got)
+	}
+	if got := res.Header.Get("Last-Modified"); lastModified != "" && got != "" && got != lastModified {
+		return fmt.Sprintf("Last-Modified was %s, now %s", lastModified, got)
+	}
+	return ""
+}
+
+// parseContentRange parses a Content-Range header of the form <unit> <start>-<end>/<total>
+// total is -1 if the server does not know it (<unit> <start>-<end>/*)
+func parseContentRange(header string) (unit string, start, end, total int64, err error) {
+	err = fmt.Errorf("malformed Content-Range %q", header)
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return
+	}
+	unit = parts[0]
+	slash := strings.Index(parts[1], "/")
+	dash := strings.Index(parts[1], "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return
+	}
+	var parseErr error
+	if start, parseErr = strconv.ParseInt(parts[1][:dash], 10, 64); parseErr != nil {
+		return
+	}
+	if end, parseErr = strconv.ParseInt(parts[1][dash+1:slash], 10, 64); parseErr != nil {
+		return
+	}
+	total = -1
+	if totalString := parts[1][slash+1:]; totalString != "*" {
+		if total, parseErr = strconv.ParseInt(totalString, 10, 64); parseErr != nil {
+			return
+		}
+	}
+	if start > end || (total >= 0 && end >= total) {
+		return
+	}
+	return unit, start, end, total, nil
+}
+
+// validateRangeResponse checks that res is the partial content chunk asked for, from the same
+// version of the resource as every other chunk. A server answering with the whole resource
+// instead (200 OK) either ignores ranges, reported as ErrRangeUnsupported, or has a new version
+// of the resource which failed the If-Range condition, reported as ErrResourceChanged
+func validateRangeResponse(res *http.Response, chunk Chunk) error {
+	if changed := changedValidator(res, chunk.etag, chunk.lastModified); changed != "" {
+		return fmt.Errorf("%w: %s", ErrResourceChanged, changed)
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return ErrRangeUnsupported
+	case http.StatusPreconditionFailed:
+		return ErrResourceChanged
+	default:
+		return &StatusError{Code: res.StatusCode, Status: res.Status, RetryAfter: parseRetryAfter(res)}
+	}
+	unit, start, end, total, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if unit != chunk.chunkType || start != chunk.start || end != chunk.end-1 {
+		return fmt.Errorf("server sent %s %d-%d instead of the requested %s %d-%d",
+			unit, start, end, chunk.chunkType, chunk.start, chunk.end-1)
+	}
+	if total >= 0 && total != chunk.total {
+		return fmt.Errorf("server reports a total length of %d, expected %d", total, chunk.total)
+	}
+	return nil
+}
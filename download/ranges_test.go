@@ -0,0 +1,180 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+/*
+  Tests for validating range responses
+*/
+
+func TestRangeHeader(t *testing.T) {
+	chunk := Chunk{chunkType: "bytes", start: 0, end: ChunkSize}
+	if header := rangeHeader(chunk); header != "bytes=0-63999" {
+		t.Errorf("expected last byte of the chunk to be included, got %s", header)
+	}
+}
+
+func TestIfRangeHeader(t *testing.T) {
+	ifRangeTests := []struct {
+		etag         string
+		lastModified string
+		expected     string
+	}{
+		{`"abc"`, "Wed, 21 Oct 2015 07:28:00 GMT", `"abc"`},
+		{`W/"abc"`, "Wed, 21 Oct 2015 07:28:00 GMT", "Wed, 21 Oct 2015 07:28:00 GMT"},
+		{`W/"abc"`, "", ""},
+		{"", "", ""},
+	}
+	for _, test := range ifRangeTests {
+		if header := ifRangeHeader(test.etag, test.lastModified); header != test.expected {
+			t.Errorf("If-Range for %s and %s: expected %q, got %q", test.etag, test.lastModified, test.expected, header)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	contentRangeTests := []struct {
+		in    string
+		start int64
+		end   int64
+		total int64
+		valid bool
+	}{
+		{"bytes 0-499/1234", 0, 499, 1234, true},
+		{"bytes 500-999/*", 500, 999, -1, true},
+		{"bytes 0-0/1", 0, 0, 1, true},
+		{"bytes 500-499/1234", 0, 0, 0, false},
+		{"bytes 0-1234/1234", 0, 0, 0, false},
+		{"bytes */1234", 0, 0, 0, false},
+		{"bytes 0-499", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+	for _, test := range contentRangeTests {
+		unit, start, end, total, err := parseContentRange(test.in)
+		if (err == nil) != test.valid {
+			t.Errorf("parsing %q: expected valid %v, got error %v", test.in, test.valid, err)
+			continue
+		}
+		if test.valid && (unit != "bytes" || start != test.start || end != test.end || total != test.total) {
+			t.Errorf("parsing %q: got %s %d-%d/%d", test.in, unit, start, end, total)
+		}
+	}
+}
+
+// Every way of misanswering a range request is caught before anything is written
+func TestDownloadChunkInvalidResponses(t *testing.T) {
+	responseTests := []struct {
+		mode  string
+		error string
+	}{
+		{"", ""},
+		{"ignore", ErrRangeUnsupported.Error()},
+		{"error-page", ErrRangeUnsupported.Error()},
+		{"wrong-range", "instead of the requested bytes 0-63999"},
+		{"wrong-total", "server reports a total length of 1000001"},
+		{"short", "EOF"},
+	}
+	for _, test := range responseTests {
+		url, err := getTestURL("/fail-range?mode=" + test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &recordingWriterAt{}
+		chunk := Chunk{OffsetWriter: OffsetWriter{WriterAt: w}, URL: url, chunkType: "bytes", end: ChunkSize, total: TestFileSize}
+		err = testClient.downloadChunk(context.Background(), chunk)
+		if test.error == "" {
+			if err != nil {
+				t.Errorf("mode %q: unexpected error %v", test.mode, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("mode %q: expected error containing %q, got %v", test.mode, test.error, err)
+		}
+		if test.error != "EOF" && w.written > 0 {
+			t.Errorf("mode %q: %d bytes written from an invalid response", test.mode, w.written)
+		}
+	}
+
+	url, err := getTestURL("/fail-range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := Chunk{OffsetWriter: OffsetWriter{WriterAt: &recordingWriterAt{}}, URL: url, chunkType: "bytes", start: FailAt, end: FailAt + 1, total: TestFileSize}
+	var statusErr *StatusError
+	if err := testClient.downloadChunk(context.Background(), chunk); !errors.As(err, &statusErr) || statusErr.Code != 500 {
+		t.Errorf("expected status error 500, got %v", err)
+	}
+}
+
+// A server that promises range support but ignores Range headers is downloaded in a single stream
+func TestDownloadRangeIgnoredFallback(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, mode := range []string{"ignore", "error-page"} {
+		url, err := getTestURL("/fail-range?mode=" + mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := testClient.Download(context.Background(), Request{URL: url, Output: mode, Dir: dir})
+		if err != nil {
+			t.Fatalf("mode %q: %v", mode, err)
+		}
+		checkDownloadedFile(t, res.Path)
+		if _, err := os.Stat(statePath(res.Path)); !os.IsNotExist(err) {
+			t.Errorf("mode %q: state file left behind", mode)
+		}
+	}
+}
+
+// Counts bytes written without keeping them
+type recordingWriterAt struct {
+	written int
+}
+
+func (w *recordingWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	w.written += len(b)
+	return len(b), nil
+}
+
+// A resource changing part way through a download is never pieced together from both versions
+func TestDownloadResourceChanged(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/changing?at=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt64(&changingRequests, 0)
+	_, err = testClient.Download(context.Background(), Request{URL: url, Dir: dir})
+	if !errors.Is(err, ErrResourceChanged) {
+		t.Errorf("expected resource changed error, got %v", err)
+	}
+
+	atomic.StoreInt64(&changingRequests, 0)
+	restartOptions := testOptions
+	restartOptions.RestartOnChange = true
+	restartClient := NewClient(restartOptions)
+	res, err := restartClient.Download(context.Background(), Request{URL: url, Dir: dir, Clobber: AutoRename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Capabilities.ETag != `"v2"` {
+		t.Errorf("expected download of the new version, got ETag %s", res.Capabilities.ETag)
+	}
+	checkDownloadedFile(t, res.Path)
+}
@@ -0,0 +1,173 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateWindow limits the download rate to Rate bytes a second between two times of day.
+// A window whose To is before its From runs past midnight, e.g. 22:00-06:00
+type RateWindow struct {
+	From time.Duration // Time of day, as the time since midnight
+	To   time.Duration
+	Rate int64 // 0 for no limit
+}
+
+// contains reports whether the time of day t falls in the window
+func (w RateWindow) contains(t time.Duration) bool {
+	if w.From <= w.To {
+		return t >= w.From && t < w.To
+	}
+	return t >= w.From || t < w.To
+}
+
+// ParseRate parses a rate in bytes a second with an optional unit, e.g. 5MB/s, 500KiB or 0 for no limit
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" {
+		return 0, nil
+	}
+	return ParseSize(strings.TrimSuffix(s, "/s"))
+}
+
+// ParseRateWindow parses a window of the day with its own rate in <from>-<to>=<rate> form,
+// e.g. 09:00-17:00=1MB/s
+func ParseRateWindow(s string) (RateWindow, error) {
+	parts := strings.SplitN(s, "=", 2)
+	times := strings.SplitN(parts[0], "-", 2)
+	if len(parts) != 2 || len(times) != 2 {
+		return RateWindow{}, fmt.Errorf("invalid rate window %q, should be <HH:MM>-<HH:MM>=<rate>", s)
+	}
+	var w RateWindow
+	var err error
+	for i, field := range []*time.Duration{&w.From, &w.To} {
+		t, parseErr := time.Parse("15:04", strings.TrimSpace(times[i]))
+		if parseErr != nil {
+			return RateWindow{}, fmt.Errorf("invalid rate window %q: %v", s, parseErr)
+		}
+		*field = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.Rate, err = ParseRate(parts[1]); err != nil {
+		return RateWindow{}, err
+	}
+	return w, nil
+}
+
+// Reads through a rate limited reader are at most this large, so that waits stay short and even
+const maxLimitedRead = 32 << 10
+
+// rateLimiter is a token bucket refilled at rate bytes a second, or at the rate of the schedule
+// window the time of day falls in. The bucket holds a tenth of a second's worth of bytes,
+// but never less than a single read of maxLimitedRead, so transfers may burst that far ahead
+// of the rate. Readers take tokens after a read and wait while the bucket is in debt,
+// which lets concurrent readers share the rate
+type rateLimiter struct {
+	mu       sync.Mutex
+	rate     int64
+	schedule []RateWindow
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+}
+
+func newRateLimiter(rate int64, schedule []RateWindow) *rateLimiter {
+	return &rateLimiter{rate: rate, schedule: schedule, now: time.Now}
+}
+
+// limited reports whether the limiter can ever hold a transfer back
+func (l *rateLimiter) limited() bool {
+	if l.rate > 0 {
+		return true
+	}
+	for _, w := range l.schedule {
+		if w.Rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rateAt is the rate in force at t, 0 for no limit
+func (l *rateLimiter) rateAt(t time.Time) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for _, w := range l.schedule {
+		if w.contains(t.Sub(midnight)) {
+			return w.Rate
+		}
+	}
+	return l.rate
+}
+
+// wait takes n tokens, blocking until the bucket is out of debt
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := l.now()
+	rate := float64(l.rateAt(now))
+	if rate <= 0 {
+		l.last = time.Time{}
+		l.mu.Unlock()
+		return nil
+	}
+	burst := rate / 10
+	if burst < maxLimitedRead {
+		burst = maxLimitedRead
+	}
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else if l.tokens += now.Sub(l.last).Seconds() * rate; l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	return sleep(ctx, delay)
+}
+
+// limitedReader reads from r no faster than every one of limiters allows,
+// keeping the time spent waiting on them in pauses
+type limitedReader struct {
+	io.Reader
+	ctx      context.Context
+	limiters []*rateLimiter
+	pauses   *pauseClock
+}
+
+func (r *limitedReader) Read(b []byte) (n int, err error) {
+	if len(b) > maxLimitedRead {
+		b = b[:maxLimitedRead]
+	}
+	n, err = r.Reader.Read(b)
+	resume := r.pauses.pause()
+	defer resume()
+	for _, limiter := range r.limiters {
+		if waitErr := limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return
+}
+
+// limitReader wraps the body of a response in the Client's rate limits:
+// the RateLimit shared by every transfer, and a ConnectionRateLimit of its own.
+// Time held back by them is kept in pauses, so that it does not count as the transfer stalling
+func (c *Client) limitReader(ctx context.Context, body io.Reader, pauses *pauseClock) io.Reader {
+	var limiters []*rateLimiter
+	if c.limiter.limited() {
+		limiters = append(limiters, c.limiter)
+	}
+	if c.ConnectionRateLimit > 0 {
+		limiters = append(limiters, newRateLimiter(c.ConnectionRateLimit, nil))
+	}
+	if len(limiters) == 0 {
+		return body
+	}
+	return &limitedReader{Reader: body, ctx: ctx, limiters: limiters, pauses: pauses}
+}
@@ -0,0 +1,91 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+  Tests for bandwidth limiting
+*/
+
+func TestParseRateWindow(t *testing.T) {
+	w, err := ParseRateWindow("22:30-06:00=1MB/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.From != 22*time.Hour+30*time.Minute || w.To != 6*time.Hour || w.Rate != 1000000 {
+		t.Errorf("parsed %+v", w)
+	}
+	for _, invalid := range []string{"22:30-06:00", "22:30=1MB/s", "25:00-06:00=1MB/s", "22:30-06:00=fast"} {
+		if _, err := ParseRateWindow(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	limiter := newRateLimiter(0, []RateWindow{
+		{From: 9 * time.Hour, To: 17 * time.Hour, Rate: 1000},
+		{From: 22 * time.Hour, To: 6 * time.Hour, Rate: 5000},
+	})
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	for hour, rate := range map[int]int64{0: 5000, 6: 0, 8: 0, 9: 1000, 16: 1000, 17: 0, 22: 5000, 23: 5000} {
+		if r := limiter.rateAt(day.Add(time.Duration(hour) * time.Hour)); r != rate {
+			t.Errorf("%d:00: expected a rate of %d, got %d", hour, rate, r)
+		}
+	}
+}
+
+// Readers sharing a limiter are held to its rate together, after an initial burst
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1000000, nil)
+	began := time.Now()
+	done := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			r := &limitedReader{Reader: bytes.NewReader(make([]byte, 100000)), ctx: context.Background(), limiters: []*rateLimiter{limiter}, pauses: &pauseClock{}}
+			_, err := io.Copy(ioutil.Discard, r)
+			done <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 300kB at 1MB/s, less the 100kB burst
+	if elapsed := time.Since(began); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected 300kB to take about 200ms at 1MB/s, took %v", elapsed)
+	}
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.RateLimit = 4000000
+	opts.ConnectionRateLimit = 2000000
+	began := time.Now()
+	res, err := NewClient(opts).Download(context.Background(), Request{URL: url, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1MB at 4MB/s, less the 400kB burst
+	if elapsed := time.Since(began); elapsed < 100*time.Millisecond {
+		t.Errorf("downloaded 1MB in %v with a limit of 4MB/s", elapsed)
+	}
+	checkDownloadedFile(t, res.Path)
+}
@@ -0,0 +1,299 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// span is a contiguous run of chunks [next, end) owned by one worker.
+// next moves up as the worker completes chunks, end moves down when another worker steals from it
+type span struct {
+	next    int64
+	end     int64
+	attempt int // Failed attempts since the last chunk of the span completed
+
+	// Progress of the span since it was taken, to find the slowest one in the end game
+	taken  time.Time
+	from   int64
+	offset int64
+	// In the end game a second worker races the owner of the span,
+	// whichever finishes first cancels the other
+	duplicated bool
+	cancels    []context.CancelFunc
+}
+
+// rate is the download speed of sp in bytes per second
+func (sp *span) rate() float64 {
+	return float64(sp.offset-sp.from) / time.Since(sp.taken).Seconds()
+}
+
+// scheduler hands out the chunks of a download to workers as large contiguous spans,
+// so that a whole span is fetched with a single range request.
+// A worker that runs out of work steals the second half of the largest remaining span,
+// which keeps every connection busy until the end without a fixed grid of tiny requests.
+// Spans are never split finer than a chunk, so State.ChunkSize is the minimum split size
+type scheduler struct {
+	written int64 // Bytes written by every worker, accessed atomically
+
+	mu      sync.Mutex
+	state   *State
+	pending []*span       // Spans no worker has taken yet
+	active  []*span       // Spans being downloaded
+	changed chan struct{} // Closed when a span is done or handed back, for idle workers waiting on it
+}
+
+// newScheduler divides the chunks not yet completed in state into at least nWorkers spans, if there are enough chunks
+func newScheduler(state *State, nWorkers int) *scheduler {
+	s := &scheduler{state: state}
+	// Completed chunks of a resumed download split the rest into runs
+	for i := int64(0); i < state.nChunks(); i++ {
+		if state.isComplete(i) {
+			continue
+		}
+		if n := len(s.pending); n > 0 && s.pending[n-1].end == i {
+			s.pending[n-1].end++
+		} else {
+			s.pending = append(s.pending, &span{next: i, end: i + 1})
+		}
+	}
+	for len(s.pending) < nWorkers {
+		stolen := split(s.pending)
+		if stolen == nil {
+			break
+		}
+		s.pending = append(s.pending, stolen)
+	}
+	return s
+}
+
+// split takes the second half off the largest of spans, nil if none has more than one chunk left
+func split(spans []*span) *span {
+	var largest *span
+	for _, sp := range spans {
+		if largest == nil || sp.end-sp.next > largest.end-largest.next {
+			largest = sp
+		}
+	}
+	if largest == nil || largest.end-largest.next < 2 {
+		return nil
+	}
+	// The owner keeps the first half, which it may already be downloading
+	mid := largest.next + (largest.end-largest.next)/2
+	stolen := &span{next: mid, end: largest.end}
+	largest.end = mid
+	return stolen
+}
+
+// take gives a worker a span to download, stealing half of another worker's span once none are pending.
+// nil means there is nothing left worth taking
+func (s *scheduler) take() *span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sp *span
+	if n := len(s.pending); n > 0 {
+		sp = s.pending[0]
+		s.pending = s.pending[1:]
+	} else if sp = split(s.active); sp == nil {
+		return nil
+	}
+	sp.taken, sp.from = time.Now(), s.chunkStart(sp.next)
+	sp.offset = sp.from
+	s.active = append(s.active, sp)
+	return sp
+}
+
+// duplicate picks the slowest span still being downloaded for an idle worker to fetch as well,
+// once there is nothing left to take. Every span is duplicated at most once,
+// nil means there is no span left to help with
+func (s *scheduler) duplicate() *span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var slowest *span
+	for _, sp := range s.active {
+		if sp.duplicated || sp.next >= sp.end {
+			continue
+		}
+		if slowest == nil || sp.rate() < slowest.rate() {
+			slowest = sp
+		}
+	}
+	if slowest != nil {
+		slowest.duplicated = true
+	}
+	return slowest
+}
+
+// join registers cancel as the way to stop a worker downloading sp once it is done
+func (s *scheduler) join(sp *span, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp.cancels = append(sp.cancels, cancel)
+}
+
+// done retires a span once it is complete, cancelling any worker still downloading it
+func (s *scheduler) done(sp *span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cancel := range sp.cancels {
+		cancel()
+	}
+	s.retire(sp)
+}
+
+// release hands back a span its owner stopped downloading before it was complete,
+// for another worker to take
+func (s *scheduler) release(sp *span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retire(sp) {
+		sp.duplicated = false
+		s.pending = append(s.pending, sp)
+	}
+}
+
+// retire removes sp from the active spans and wakes up idle workers, reporting whether it was active
+func (s *scheduler) retire(sp *span) bool {
+	for i, active := range s.active {
+		if active == sp {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			if s.changed != nil {
+				close(s.changed)
+				s.changed = nil
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// idle is for a worker that found nothing to take or duplicate. It reports whether the whole
+// download is finished, and if not, returns a channel closed once there may be work again
+func (s *scheduler) idle() (changed <-chan struct{}, finished bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 && len(s.active) == 0 {
+		return nil, true
+	}
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed, false
+}
+
+// byteRange returns the byte range [start, end) still to be downloaded for sp
+func (s *scheduler) byteRange(sp *span) (start int64, end int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chunkStart(sp.next), s.chunkStart(sp.end)
+}
+
+// remaining reports whether sp has chunks left to download
+func (s *scheduler) remaining(sp *span) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sp.next < sp.end
+}
+
+// failed counts a failed attempt at sp, returning how many there have been since it last made progress
+func (s *scheduler) failed(sp *span) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp.attempt++
+	return sp.attempt
+}
+
+// advance records that the bytes of sp up to offset have been written,
+// returning the chunks this completed
+func (s *scheduler) advance(sp *span, offset int64) (completed []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset > sp.offset {
+		sp.offset = offset
+	}
+	next := offset / s.state.ChunkSize
+	if offset >= s.state.Length {
+		next = s.state.nChunks()
+	}
+	// Anything past end was stolen, its new owner reports it
+	if next > sp.end {
+		next = sp.end
+	}
+	for ; sp.next < next; sp.next++ {
+		completed = append(completed, sp.next)
+		sp.attempt = 0
+	}
+	return
+}
+
+// partial counts the bytes written past the completed chunks of the spans being downloaded
+func (s *scheduler) partial() (n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sp := range s.active {
+		if written := sp.offset - s.chunkStart(sp.next); written > 0 {
+			n += written
+		}
+	}
+	return
+}
+
+// chunkStart is the offset of chunk i, or the length of the resource past the last chunk
+func (s *scheduler) chunkStart(i int64) int64 {
+	if start := i * s.state.ChunkSize; start < s.state.Length {
+		return start
+	}
+	return s.state.Length
+}
+
+// errSpanDone stops the transfer of a span once it reaches the end of what is left of it
+var errSpanDone = errors.New("rest of span taken by another worker")
+
+// spanWriter writes the body of a span's range request, reporting every chunk it completes.
+// A response running past the end of the span, because another worker stole the rest of it,
+// is cut short with errSpanDone. With pieces, a chunk is only reported once it is verified
+type spanWriter struct {
+	io.WriterAt
+	sched    *scheduler
+	span     *span
+	pieces   *pieceHasher // nil without piece checksums
+	complete func(i int64) error
+	written  int64 // Accessed atomically, progress is reported while it is written
+}
+
+func (w *spanWriter) WriteAt(b []byte, off int64) (n int, err error) {
+	_, end := w.sched.byteRange(w.span)
+	cut := off+int64(len(b)) > end
+	if cut {
+		if off >= end {
+			return 0, errSpanDone
+		}
+		b = b[:end-off]
+	}
+	n, err = w.WriterAt.WriteAt(b, off)
+	atomic.AddInt64(&w.sched.written, int64(n))
+	atomic.AddInt64(&w.written, int64(n))
+	verified := off + int64(n)
+	if w.pieces != nil {
+		var pieceErr error
+		if verified, pieceErr = w.pieces.write(b[:n], off); pieceErr != nil && err == nil {
+			// Bytes of a bad piece do not count as written, a short write is what stops io.CopyN
+			err = pieceErr
+			if n = 0; verified > off {
+				n = int(verified - off)
+			}
+		}
+	}
+	for _, i := range w.sched.advance(w.span, verified) {
+		if completeErr := w.complete(i); completeErr != nil {
+			return n, completeErr
+		}
+	}
+	if err == nil && cut {
+		err = errSpanDone
+	}
+	return
+}
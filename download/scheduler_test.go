@@ -0,0 +1,153 @@
+package download
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+  Tests for the work stealing scheduler
+*/
+
+func TestNewScheduler(t *testing.T) {
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := newTestState(url)
+	state.markComplete(5)
+	sched := newScheduler(state, 4)
+	covered := make([]bool, state.nChunks())
+	for _, sp := range sched.pending {
+		for i := sp.next; i < sp.end; i++ {
+			if covered[i] {
+				t.Errorf("chunk %d in more than one span", i)
+			}
+			covered[i] = true
+		}
+	}
+	for i, c := range covered {
+		if c == state.isComplete(int64(i)) {
+			t.Errorf("chunk %d: completed %v, but in a span %v", i, state.isComplete(int64(i)), c)
+		}
+	}
+	if len(sched.pending) < 4 {
+		t.Errorf("expected at least 4 spans, got %d", len(sched.pending))
+	}
+}
+
+func TestSchedulerSteal(t *testing.T) {
+	sched := &scheduler{state: &State{Length: 10 * ChunkSize, ChunkSize: ChunkSize}}
+	sched.pending = []*span{{next: 0, end: 10}}
+	owner := sched.take()
+	thief := sched.take()
+	if owner.end != 5 || thief.next != 5 || thief.end != 10 {
+		t.Errorf("expected spans 0-5 and 5-10, got %d-%d and %d-%d", owner.next, owner.end, thief.next, thief.end)
+	}
+	// The chunk an owner is working on is never stolen
+	sched.advance(thief, 9*ChunkSize)
+	sched.done(owner)
+	if sp := sched.take(); sp != nil {
+		t.Errorf("stole %d-%d from a span with one chunk left", sp.next, sp.end)
+	}
+}
+
+// countingTransport counts the requests made through it
+type countingTransport struct {
+	http.RoundTripper
+	requests int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.requests, 1)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// A download split into many small chunks still takes only a few requests per connection
+func TestDownloadParallelRequestCount(t *testing.T) {
+	downloadTest, err := ioutil.TempFile(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadTest.Close()
+	defer os.Remove(downloadTest.Name())
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &countingTransport{RoundTripper: http.DefaultTransport}
+	opts := testOptions
+	opts.ChunkSize = 1000
+	opts.HTTPClient = &http.Client{Transport: transport}
+	state := newState(url, Capabilities{ChunkType: "bytes", Length: TestFileSize, CanRange: true}, opts.ChunkSize, "")
+	_, err = NewClient(opts).downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.nCompleted() != state.nChunks() {
+		t.Errorf("expected all %d chunks complete, got %d", state.nChunks(), state.nCompleted())
+	}
+	if requests := atomic.LoadInt64(&transport.requests); requests > state.nChunks()/10 {
+		t.Errorf("%d requests for %d chunks", requests, state.nChunks())
+	}
+	checkDownloadedFile(t, downloadTest.Name())
+}
+
+// A span stuck on a slow connection is fetched again by an idle worker, instead of holding up the download
+func TestDownloadParallelEndGame(t *testing.T) {
+	downloadTest, err := ioutil.TempFile(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadTest.Close()
+	defer os.Remove(downloadTest.Name())
+	url, err := getTestURL("/lag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&lagRequests, 0)
+	// Without the end game, the last chunk of the lagging span alone takes ChunkSize/10kB/s = 6.4s
+	began := time.Now()
+	_, err = testClient.downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, newTestState(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(began); elapsed > 2*time.Second {
+		t.Errorf("download held up for %v by a lagging connection", elapsed)
+	}
+	checkDownloadedFile(t, downloadTest.Name())
+}
+
+func TestSchedulerDuplicate(t *testing.T) {
+	sched := &scheduler{state: &State{Length: 2 * ChunkSize, ChunkSize: ChunkSize}}
+	sched.pending = []*span{{next: 0, end: 1}, {next: 1, end: 2}}
+	fast, slow := sched.take(), sched.take()
+	sched.advance(fast, ChunkSize/2)
+	if sp := sched.take(); sp != nil {
+		t.Errorf("took %d-%d with every span down to one chunk", sp.next, sp.end)
+	}
+	if sp := sched.duplicate(); sp != slow {
+		t.Errorf("expected the slowest span to be duplicated, got %v", sp)
+	}
+	if sp := sched.duplicate(); sp != fast {
+		t.Errorf("expected the remaining span to be duplicated, got %v", sp)
+	}
+	if sp := sched.duplicate(); sp != nil {
+		t.Errorf("duplicated span %d-%d twice", sp.next, sp.end)
+	}
+
+	// Finishing a span cancels every worker still downloading it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sched.join(slow, cancel)
+	sched.advance(slow, 2*ChunkSize)
+	sched.done(slow)
+	if ctx.Err() == nil {
+		t.Error("worker racing a finished span was not cancelled")
+	}
+}
@@ -0,0 +1,66 @@
+package download
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Size suffixes understood by ParseSize, decimal (kB = 1000) and binary (KiB = 1024)
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1000 * 1000,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"t":   1000 * 1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+}
+
+// ParseSize parses a number of bytes with an optional unit, e.g. 64000, 64kB, 4MiB or 1.5GB
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q, unknown unit %q", s, s[i:])
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, should be a number of bytes with an optional unit such as kB or MiB", s)
+	}
+	// MaxInt64 rounds up to 2^63 as a float, which is already out of range
+	size := n * float64(unit)
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q, too large", s)
+	}
+	return int64(size), nil
+}
+
+// FormatSize formats a number of bytes with a binary unit, e.g. 4.0MiB
+func FormatSize(n int64) string {
+	if n < 1<<10 {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	size, unit := float64(n)/(1<<10), "KiB"
+	for _, next := range []string{"MiB", "GiB", "TiB"} {
+		if size < 1<<10 {
+			break
+		}
+		size, unit = size/(1<<10), next
+	}
+	return strconv.FormatFloat(size, 'f', 1, 64) + unit
+}
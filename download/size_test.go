@@ -0,0 +1,48 @@
+package download
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	sizeTests := []struct {
+		in   string
+		size int64
+		err  bool
+	}{
+		{"64000", 64000, false},
+		{"64kB", 64000, false},
+		{"64 KiB", 64 << 10, false},
+		{"4MiB", 4 << 20, false},
+		{"4m", 4000000, false},
+		{"1.5GB", 1500000000, false},
+		{"2TiB", 2 << 40, false},
+		{"100B", 100, false},
+		{"", 0, true},
+		{"MiB", 0, true},
+		{"4 parsecs", 0, true},
+		{"-1kB", 0, true},
+		{"9999999TiB", 0, true},
+		{"8388608TiB", 0, true},
+	}
+	for _, test := range sizeTests {
+		size, err := ParseSize(test.in)
+		if (err != nil) != test.err || size != test.size {
+			t.Errorf("ParseSize(%q): expected %d (error %v), got %d, %v", test.in, test.size, test.err, size, err)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for n, expected := range map[int64]string{
+		100:           "100B",
+		64000:         "62.5KiB",
+		4 << 20:       "4.0MiB",
+		3 << 30:       "3.0GiB",
+		5 << 40:       "5.0TiB",
+		5 << 50:       "5120.0TiB",
+		1<<20 + 1<<19: "1.5MiB",
+	} {
+		if s := FormatSize(n); s != expected {
+			t.Errorf("FormatSize(%d): expected %s, got %s", n, expected, s)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// countingReader counts the bytes read through it, safe to load from another goroutine
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	atomic.AddInt64(&r.n, int64(n))
+	return
+}
+
+// pauseClock adds up the time a transfer is held back on purpose, waiting on rate limits,
+// which is not held against it as idle or slow. Safe to load from another goroutine
+type pauseClock struct {
+	total int64 // Nanoseconds of the pauses that are over
+	since int64 // UnixNano the pause in progress started at, 0 if there is none
+}
+
+// pause starts a pause, ended by calling the returned function
+func (c *pauseClock) pause() (resume func()) {
+	began := time.Now()
+	atomic.StoreInt64(&c.since, began.UnixNano())
+	return func() {
+		// Counted in the total before the pause ends, so that it is never missed in between
+		atomic.AddInt64(&c.total, int64(time.Since(began)))
+		atomic.StoreInt64(&c.since, 0)
+	}
+}
+
+// paused returns the time spent paused up to now
+func (c *pauseClock) paused(now time.Time) time.Duration {
+	paused := time.Duration(atomic.LoadInt64(&c.total))
+	if since := atomic.LoadInt64(&c.since); since != 0 {
+		paused += now.Sub(time.Unix(0, since))
+	}
+	return paused
+}
+
+// watchTransfer calls cancel when a transfer counted by r stalls: no bytes for idleTimeout,
+// or fewer than minSpeed bytes a second over a stallTime window. Zero disables either check.
+// Time spent paused on pauses does not count towards either.
+// The returned function stops watching and reports ErrStalled if the transfer was cancelled
+func watchTransfer(r *countingReader, pauses *pauseClock, idleTimeout time.Duration, minSpeed int64, stallTime time.Duration, cancel context.CancelFunc) (stop func() error) {
+	if idleTimeout <= 0 && (minSpeed <= 0 || stallTime <= 0) {
+		return func() error { return nil }
+	}
+	// Check often enough to notice a stall soon after the limit is crossed
+	interval := idleTimeout
+	if minSpeed > 0 && stallTime > 0 && (interval <= 0 || stallTime < interval) {
+		interval = stallTime
+	}
+	interval /= 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		// Both clocks run on the time the transfer was not paused
+		last, lastProgress := int64(0), time.Duration(0)
+		windowStart, windowBytes := time.Duration(0), int64(0)
+		began := time.Now()
+		for {
+			select {
+			case <-done:
+				result <- nil
+				return
+			case now := <-ticker.C:
+				active := now.Sub(began) - pauses.paused(now)
+				read := atomic.LoadInt64(&r.n)
+				if read != last {
+					last, lastProgress = read, active
+				}
+				if idleTimeout > 0 && active-lastProgress >= idleTimeout {
+					cancel()
+					result <- fmt.Errorf("%w: no data received for %v", ErrStalled, idleTimeout)
+					return
+				}
+				if minSpeed > 0 && stallTime > 0 && active-windowStart >= stallTime {
+					speed := float64(read-windowBytes) / (active - windowStart).Seconds()
+					if speed < float64(minSpeed) {
+						cancel()
+						result <- fmt.Errorf("%w: %.0f bytes/s over the last %v, below the minimum of %d bytes/s",
+							ErrStalled, speed, stallTime, minSpeed)
+						return
+					}
+					windowStart, windowBytes = active, read
+				}
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
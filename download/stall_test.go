@@ -0,0 +1,104 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+  Tests for timeouts and stall detection
+*/
+
+func TestDownloadChunkStalled(t *testing.T) {
+	stallTests := []struct {
+		path    string
+		options func(*Options)
+	}{
+		{"/stall", func(opts *Options) { opts.IdleTimeout = 100 * time.Millisecond }},
+		{"/trickle", func(opts *Options) { opts.MinSpeed, opts.StallTime = 100000, 200*time.Millisecond }},
+		{"/trickle", func(opts *Options) { opts.ChunkTimeout = 200 * time.Millisecond }},
+	}
+	for _, test := range stallTests {
+		url, err := getTestURL(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := testOptions
+		test.options(&opts)
+		atomic.StoreInt64(&stallRequests, 0)
+		chunk := Chunk{OffsetWriter: OffsetWriter{WriterAt: &recordingWriterAt{}}, URL: url, chunkType: "bytes", end: ChunkSize, total: TestFileSize}
+		began := time.Now()
+		err = NewClient(opts).downloadChunk(context.Background(), chunk)
+		if opts.ChunkTimeout > 0 {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("%s: expected chunk timeout, got %v", test.path, err)
+			}
+		} else if !errors.Is(err, ErrStalled) {
+			t.Errorf("%s: expected stall, got %v", test.path, err)
+		}
+		if elapsed := time.Since(began); elapsed > time.Second {
+			t.Errorf("%s: took %v to give up on the chunk", test.path, elapsed)
+		}
+	}
+}
+
+// Waiting on rate limits is neither idle nor slow, the transfer is only held back on purpose
+func TestDownloadChunkRateLimitedNotStalled(t *testing.T) {
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.ConnectionRateLimit = 200000
+	opts.IdleTimeout = 50 * time.Millisecond
+	opts.MinSpeed, opts.StallTime = 1000000, 100*time.Millisecond
+	chunk := Chunk{OffsetWriter: OffsetWriter{WriterAt: &recordingWriterAt{}}, URL: url, chunkType: "bytes", end: ChunkSize, total: TestFileSize}
+	if err := NewClient(opts).downloadChunk(context.Background(), chunk); err != nil {
+		t.Errorf("expected the rate limited chunk to complete, got %v", err)
+	}
+}
+
+// A stalled chunk is abandoned and retried, instead of holding up the download forever
+func TestDownloadParallelStallRetried(t *testing.T) {
+	downloadTest, err := ioutil.TempFile(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadTest.Close()
+	defer os.Remove(downloadTest.Name())
+	url, err := getTestURL("/stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.IdleTimeout = 100 * time.Millisecond
+	atomic.StoreInt64(&stallRequests, 0)
+	_, err = NewClient(opts).downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, newTestState(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloadedFile(t, downloadTest.Name())
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url, err := getTestURL("/trickle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.Timeout = 200 * time.Millisecond
+	_, err = NewClient(opts).Download(context.Background(), Request{URL: url, Dir: dir})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected download timeout, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+)
+
+// StateSuffix is appended to the output path to name the sidecar file
+// which records the progress of a parallel download
+const StateSuffix = ".doubleup"
+
+// State is persisted next to a partially downloaded file so that an interrupted
+// download can be resumed without fetching the chunks that already completed.
+// Completed is a bitmap with one bit per chunk, chunk i covering bytes
+// [i*ChunkSize, min((i+1)*ChunkSize, Length))
+type State struct {
+	URL          string `json:"url"`
+	Length       int64  `json:"length"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	ChunkSize    int64  `json:"chunkSize"`
+	Completed    []byte `json:"completed"`
+
+	// Where the state is saved, empty for in-memory only state
+	path string
+	// Checksums of the chunks, verified as they are written. Not saved, they come with the request
+	pieces *Pieces
+	// Where the events of the download are reported
+	reporter *reporter
+}
+
+// statePath returns the location of the sidecar file for an output file
+func statePath(output string) string {
+	return output + StateSuffix
+}
+
+// newState creates an empty state for a fresh download of URL
+func newState(URL *url.URL, caps Capabilities, chunkSize int64, path string) *State {
+	s := &State{
+		URL:          URL.String(),
+		Length:       caps.Length,
+		ETag:         caps.ETag,
+		LastModified: caps.LastModified,
+		ChunkSize:    chunkSize,
+		path:         path,
+	}
+	s.Completed = make([]byte, (s.nChunks()+7)/8)
+	return s
+}
+
+// loadState reads a previously saved state from path
+func loadState(path string) (*State, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{path: path}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.ChunkSize < 1 || int64(len(s.Completed)) != (s.nChunks()+7)/8 {
+		return nil, &os.PathError{Op: "load state", Path: path, Err: os.ErrInvalid}
+	}
+	return s, nil
+}
+
+// findState loads the saved state of a download of URL to name. Downloads saved under another name by
+// AutoRename are looked up too, in name.1, name.2, ... up to the first that neither exists nor has a state.
+// It returns the state and the output path it belongs to, or an os.IsNotExist error if there is none
+func findState(name string, policy ClobberPolicy, URL *url.URL) (*State, string, error) {
+	s, err := loadState(statePath(name))
+	if err == nil || !os.IsNotExist(err) || policy != AutoRename {
+		return s, name, err
+	}
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d", name, i)
+		renamed, renamedErr := loadState(statePath(candidate))
+		if renamedErr == nil && renamed.URL == URL.String() {
+			return renamed, candidate, nil
+		} else if renamedErr != nil && !os.IsNotExist(renamedErr) {
+			return nil, "", renamedErr
+		}
+		if _, statErr := os.Stat(candidate); os.IsNotExist(statErr) && renamedErr != nil {
+			return nil, name, err
+		}
+	}
+}
+
+// matches reports whether the saved state still describes the resource on the server.
+// A changed length, ETag or Last-Modified means the bytes on disk can no longer be trusted
+func (s *State) matches(URL *url.URL, caps Capabilities) bool {
+	return s.URL == URL.String() &&
+		s.Length == caps.Length &&
+		s.ETag == caps.ETag &&
+		s.LastModified == caps.LastModified
+}
+
+// save writes the state to its sidecar file.
+// The state is written to a temporary file first and renamed into place
+// so that an interruption never leaves a half written sidecar behind
+func (s *State) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// remove deletes the sidecar file once the download it describes has completed
+func (s *State) remove() error {
+	if s.path == "" {
+		return nil
+	}
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// nChunks is the number of chunks the download is split into
+func (s *State) nChunks() int64 {
+	return (s.Length + s.ChunkSize - 1) / s.ChunkSize
+}
+
+// nCompleted counts the chunks that have already been downloaded
+func (s *State) nCompleted() (n int64) {
+	for i := int64(0); i < s.nChunks(); i++ {
+		if s.isComplete(i) {
+			n++
+		}
+	}
+	return
+}
+
+// completedBytes counts the bytes of the chunks that have already been downloaded
+func (s *State) completedBytes() (n int64) {
+	for i := int64(0); i < s.nChunks(); i++ {
+		if s.isComplete(i) {
+			n += s.chunkEnd(i) - i*s.ChunkSize
+		}
+	}
+	return
+}
+
+// chunkEnd is one past the last byte of chunk i
+func (s *State) chunkEnd(i int64) int64 {
+	if end := (i + 1) * s.ChunkSize; end < s.Length {
+		return end
+	}
+	return s.Length
+}
+
+func (s *State) isComplete(i int64) bool {
+	return s.Completed[i/8]&(1<<uint(i%8)) != 0
+}
+
+func (s *State) markComplete(i int64) {
+	s.Completed[i/8] |= 1 << uint(i%8)
+}
@@ -0,0 +1,213 @@
+package download
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+  Tests for State
+*/
+
+func TestStateSaveLoad(t *testing.T) {
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := statePath(dir + "/out")
+
+	caps := Capabilities{ChunkType: "bytes", Length: TestFileSize, CanRange: true, ETag: `"abc"`}
+	state := newState(url, caps, ChunkSize, path)
+	state.markComplete(0)
+	state.markComplete(state.nChunks() - 1)
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.matches(url, caps) {
+		t.Error("loaded state does not match the resource it was saved for")
+	}
+	if loaded.nCompleted() != 2 || !loaded.isComplete(0) || !loaded.isComplete(loaded.nChunks()-1) {
+		t.Errorf("completed chunks not restored, got %d completed", loaded.nCompleted())
+	}
+	caps.ETag = `"def"`
+	if loaded.matches(url, caps) {
+		t.Error("state matches a resource with a different ETag")
+	}
+
+	if err := loaded.remove(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file not removed: %v", err)
+	}
+}
+
+// The state of a download saved under another name by AutoRename is found for resuming it
+func TestFindStateRenamed(t *testing.T) {
+	url, err := getTestURL("/success")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "out")
+	for _, path := range []string{name, name + ".1", name + ".2"} {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caps := Capabilities{ChunkType: "bytes", Length: TestFileSize, CanRange: true}
+	other, err := getTestURL("/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newState(other, caps, ChunkSize, statePath(name+".1")).save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := newState(url, caps, ChunkSize, statePath(name+".2")).save(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, path, err := findState(name, AutoRename, url)
+	if err != nil || path != name+".2" || !state.matches(url, caps) {
+		t.Errorf("expected the state of %s.2, got %s, %v", name, path, err)
+	}
+	if _, _, err := findState(name, Overwrite, url); !os.IsNotExist(err) {
+		t.Errorf("expected renamed outputs to be ignored without AutoRename, got %v", err)
+	}
+	if err := os.Remove(name + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(statePath(name + ".1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := findState(name, AutoRename, url); !os.IsNotExist(err) {
+		t.Errorf("expected the lookup to stop at the first free name, got %v", err)
+	}
+}
+
+// Chunks marked complete are never requested again:
+// marking the chunk /fail-range fails on as complete lets the download succeed
+func TestDownloadParallelResume(t *testing.T) {
+	testFile, err := os.Open(testFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testFile.Close()
+	downloadTest, err := ioutil.TempFile(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadTest.Close()
+	defer os.Remove(downloadTest.Name())
+	url, err := getTestURL("/fail-range")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := newTestState(url)
+	failChunk := int64(FailAt) / state.ChunkSize
+	start := failChunk * state.ChunkSize
+	if _, err := testFile.Seek(start, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(&OffsetWriter{downloadTest, start}, testFile, state.ChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	state.markComplete(failChunk)
+
+	_, err = testClient.downloadParallel(context.Background(), "bytes", testMirrors(url), downloadTest, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.nCompleted() != state.nChunks() {
+		t.Errorf("expected all %d chunks complete, got %d", state.nChunks(), state.nCompleted())
+	}
+	testFile.Seek(0, io.SeekStart)
+	downloadTest.Seek(0, io.SeekStart)
+	if err := compareBytes(testFile, downloadTest); err != nil {
+		t.Error(err)
+	}
+}
+
+// Events report a download from probing it to its end, never going back on its progress
+func TestDownloadEvents(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), TestFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	options := testOptions
+	options.RetryBudget = 2
+	client := NewClient(options)
+	for _, test := range []struct {
+		endpoint string
+		last     EventType
+	}{
+		{"/success", EventFinished},
+		{"/no-range", EventFinished},
+		{"/fail-range", EventFailed},
+	} {
+		url, err := getTestURL(test.endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []Event
+		var chunkBytes int64
+		retried := false
+		record := func(e Event) {
+			if n := len(events); n > 0 && e.Completed < events[n-1].Completed {
+				t.Errorf("%s: progress went from %d back to %d", test.endpoint, events[n-1].Completed, e.Completed)
+			}
+			if e.Total != TestFileSize {
+				t.Errorf("%s: unexpected total %d of %s", test.endpoint, e.Total, e.Type)
+			}
+			switch e.Type {
+			case EventChunkCompleted:
+				chunkBytes += e.End - e.Start
+			case EventChunkRetried:
+				retried = e.Err != nil && e.Attempt > 0
+			}
+			events = append(events, e)
+		}
+		_, err = client.Download(context.Background(), Request{URL: url, Dir: dir, Output: test.endpoint[1:], Events: record})
+		if (err == nil) != (test.last == EventFinished) {
+			t.Errorf("%s: unexpected error %v", test.endpoint, err)
+		}
+		first, last := events[0], events[len(events)-1]
+		if first.Type != EventProbed || first.Capabilities == nil || last.Type != test.last {
+			t.Fatalf("%s: expected %s to %s, got %s to %s", test.endpoint, EventProbed, test.last, first.Type, last.Type)
+		}
+		switch test.endpoint {
+		case "/success":
+			if chunkBytes != TestFileSize || last.Completed != TestFileSize || last.Result == nil {
+				t.Errorf("%s: expected chunks of %d bytes in all, got %d ending with %+v", test.endpoint, TestFileSize, chunkBytes, last)
+			}
+		case "/no-range":
+			if last.Completed != TestFileSize {
+				t.Errorf("%s: expected progress up to %d, got %d", test.endpoint, TestFileSize, last.Completed)
+			}
+		case "/fail-range":
+			if !retried || last.Err == nil {
+				t.Errorf("%s: expected retries before failing, got %+v", test.endpoint, last)
+			}
+		}
+	}
+}
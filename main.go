@@ -1,16 +1,14 @@
 package main
 
 import (
-	"fmt"
 	"github.com/stephng3/DoubleUp/cmd"
 	"os"
 )
 
 func main() {
-	// See ./cmd/root.go
+	// See ./cmd/root.go, the error has been printed already
 	err := cmd.Execute()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
-		os.Exit(1)
+		os.Exit(cmd.ExitCode(err))
 	}
 }
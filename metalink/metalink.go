@@ -0,0 +1,238 @@
+// Package metalink reads Metalink files, which list the mirrors and checksums of downloads:
+// Metalink 4 (RFC 5854, .meta4) and the older Metalink 3 (.metalink)
+package metalink
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/stephng3/DoubleUp/download"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Metalink lists the files described by a Metalink document
+type Metalink struct {
+	Files []File
+}
+
+// File is a file of a Metalink, with everything known about it
+type File struct {
+	Name   string // Relative path the file is saved at
+	Size   int64  // 0 if not given
+	Hashes []Hash // Whole file hashes
+	Pieces *Pieces
+	URLs   []URL // Ordered by priority, most preferred first
+}
+
+// Hash is a digest of a file or piece. Type is the IANA name of the algorithm, e.g. sha-256
+type Hash struct {
+	Type  string
+	Value string // Hex
+}
+
+// Pieces are the hashes of consecutive Length byte pieces of a file
+type Pieces struct {
+	Type   string
+	Length int64
+	Hashes []string // Hex
+}
+
+// URL is a location of a file. Priority 1 is the most preferred
+type URL struct {
+	URL      string
+	Priority int
+	Location string // ISO 3166-1 country code, if given
+}
+
+// Extensions of Metalink files
+var Extensions = []string{".meta4", ".metalink"}
+
+// IsMetalink reports whether a path or URL names a Metalink file, going by its extension
+func IsMetalink(name string) bool {
+	if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+		name = u.Path
+	}
+	ext := strings.ToLower(path.Ext(name))
+	for _, metalinkExt := range Extensions {
+		if ext == metalinkExt {
+			return true
+		}
+	}
+	return false
+}
+
+// xml layout of both Metalink versions. Elements are matched in any namespace,
+// Metalink 4 keeps the hashes and URLs in <file> and Metalink 3 wraps them in
+// <verification> and <resources>
+type document struct {
+	Files  []fileElement `xml:"file"`
+	Files3 []fileElement `xml:"files>file"`
+}
+
+type fileElement struct {
+	Name   string          `xml:"name,attr"`
+	Size   int64           `xml:"size"`
+	Hashes []hashElement   `xml:"hash"`
+	Pieces []piecesElement `xml:"pieces"`
+	URLs   []urlElement    `xml:"url"`
+
+	Verification struct {
+		Hashes []hashElement   `xml:"hash"`
+		Pieces []piecesElement `xml:"pieces"`
+	} `xml:"verification"`
+	Resources struct {
+		URLs []urlElement `xml:"url"`
+	} `xml:"resources"`
+}
+
+type hashElement struct {
+	Type  string `xml:"type,attr"`
+	Piece string `xml:"piece,attr"`
+	Value string `xml:",chardata"`
+}
+
+type piecesElement struct {
+	Type   string        `xml:"type,attr"`
+	Length int64         `xml:"length,attr"`
+	Hashes []hashElement `xml:"hash"`
+}
+
+type urlElement struct {
+	Priority   int    `xml:"priority,attr"`   // Metalink 4, 1 to 999999 with 1 the most preferred
+	Preference int    `xml:"preference,attr"` // Metalink 3, 0 to 100 with 100 the most preferred
+	Location   string `xml:"location,attr"`
+	Type       string `xml:"type,attr"` // Metalink 3 lists torrents and the like next to http and ftp
+	Value      string `xml:",chardata"`
+}
+
+// Parse reads a Metalink document
+func Parse(r io.Reader) (*Metalink, error) {
+	var doc document
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid metalink: %v", err)
+	}
+	m := &Metalink{}
+	for _, f := range append(doc.Files, doc.Files3...) {
+		file := File{Name: f.Name, Size: f.Size}
+		if err := checkName(file.Name); err != nil {
+			return nil, err
+		}
+		for _, h := range append(f.Hashes, f.Verification.Hashes...) {
+			file.Hashes = append(file.Hashes, Hash{Type: strings.ToLower(h.Type), Value: strings.TrimSpace(h.Value)})
+		}
+		if pieces := append(f.Pieces, f.Verification.Pieces...); len(pieces) > 0 {
+			file.Pieces = &Pieces{Type: strings.ToLower(pieces[0].Type), Length: pieces[0].Length}
+			for _, h := range pieces[0].Hashes {
+				file.Pieces.Hashes = append(file.Pieces.Hashes, strings.TrimSpace(h.Value))
+			}
+		}
+		for _, u := range f.URLs {
+			file.URLs = append(file.URLs, URL{URL: strings.TrimSpace(u.Value), Priority: u.Priority, Location: u.Location})
+		}
+		for _, u := range f.Resources.URLs {
+			if u.Type != "" && u.Type != "http" && u.Type != "https" {
+				continue
+			}
+			// Preferences run the other way, 100 becomes priority 1
+			priority := 0
+			if u.Preference > 0 {
+				priority = 101 - u.Preference
+			}
+			file.URLs = append(file.URLs, URL{URL: strings.TrimSpace(u.Value), Priority: priority, Location: u.Location})
+		}
+		// URLs without a priority come last
+		sort.SliceStable(file.URLs, func(i, j int) bool {
+			a, b := file.URLs[i].Priority, file.URLs[j].Priority
+			return a != 0 && (b == 0 || a < b)
+		})
+		m.Files = append(m.Files, file)
+	}
+	if len(m.Files) == 0 {
+		return nil, fmt.Errorf("invalid metalink: no files")
+	}
+	return m, nil
+}
+
+// checkName rejects file names that would be saved outside the download directory
+func checkName(name string) error {
+	clean := path.Clean(name)
+	if name == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(name, "\\") {
+		return fmt.Errorf("invalid metalink: unsafe file name %q", name)
+	}
+	return nil
+}
+
+// Open reads a Metalink from a local path or an http(s) URL fetched by client
+func Open(ctx context.Context, client *download.Client, source string) (*Metalink, error) {
+	r, err := client.Open(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return Parse(r)
+}
+
+// Algorithm names of Metalink hashes, IANA names for Metalink 4 and the older names of Metalink 3,
+// and the matching Checksum algorithm. Hashes of other algorithms are skipped
+var algorithms = map[string]string{
+	"md5":     "md5",
+	"sha-1":   "sha1",
+	"sha1":    "sha1",
+	"sha-256": "sha256",
+	"sha256":  "sha256",
+	"sha-512": "sha512",
+	"sha512":  "sha512",
+}
+
+// Request builds the download of the file into dir, from its most preferred URL with the others as mirrors
+func (f *File) Request(dir string) (download.Request, error) {
+	req := download.Request{Output: filepath.FromSlash(f.Name), Dir: dir, Size: f.Size}
+	for _, u := range f.URLs {
+		URL, err := url.Parse(u.URL)
+		if err != nil || (URL.Scheme != "http" && URL.Scheme != "https") {
+			// ftp and the like are not supported, and a broken URL is as good as a missing one
+			continue
+		}
+		if req.URL == nil {
+			req.URL = URL
+		} else {
+			req.Mirrors = append(req.Mirrors, URL)
+		}
+	}
+	if req.URL == nil {
+		return req, fmt.Errorf("no http(s) URL for %s in metalink", f.Name)
+	}
+	for _, h := range f.Hashes {
+		algorithm, ok := algorithms[h.Type]
+		if !ok {
+			continue
+		}
+		checksum, err := download.ParseChecksum(algorithm + ":" + h.Value)
+		if err != nil {
+			return req, fmt.Errorf("metalink hash of %s: %v", f.Name, err)
+		}
+		checksum.Source = "metalink"
+		req.Checksums = append(req.Checksums, checksum)
+	}
+	if f.Pieces != nil {
+		algorithm, ok := algorithms[f.Pieces.Type]
+		if ok {
+			pieces := &download.Pieces{Algorithm: algorithm, Length: f.Pieces.Length}
+			for i, h := range f.Pieces.Hashes {
+				sum, err := hex.DecodeString(h)
+				if err != nil {
+					return req, fmt.Errorf("metalink hash of piece %d of %s: %v", i, f.Name, err)
+				}
+				pieces.Sums = append(pieces.Sums, sum)
+			}
+			req.Pieces = pieces
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,145 @@
+package metalink
+
+import (
+	"context"
+	"fmt"
+	"github.com/stephng3/DoubleUp/download"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const meta4 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="example.iso">
+    <size>10</size>
+    <hash type="sha-256">84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882</hash>
+    <hash type="adler32">0b2c020b</hash>
+    <pieces length="4" type="sha-1">
+      <hash>7110eda4d09e062aa5e4a390b0a572ac0d2c0220</hash>
+      <hash>9c7b2a0e8a3d9e8bd7a76de2a7d06b2b69a9a5b2</hash>
+      <hash>1b6453892473a467d07372d45eb05abc2031647a</hash>
+    </pieces>
+    <url>http://fallback.example.com/example.iso</url>
+    <url priority="2" location="de">http://de.example.com/example.iso</url>
+    <url priority="1" location="us">http://us.example.com/example.iso</url>
+    <url priority="3">ftp://ftp.example.com/example.iso</url>
+  </file>
+</metalink>`
+
+const metalink3 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="example.iso">
+      <size>10</size>
+      <verification>
+        <hash type="md5">781e5e245d69b566979b86e28d23f2c7</hash>
+      </verification>
+      <resources>
+        <url type="http" preference="50">http://low.example.com/example.iso</url>
+        <url type="bittorrent" preference="100">http://example.com/example.iso.torrent</url>
+        <url type="http" preference="90">http://high.example.com/example.iso</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+func TestParseMetalink4(t *testing.T) {
+	m, err := Parse(strings.NewReader(meta4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(m.Files))
+	}
+	f := m.Files[0]
+	if f.Name != "example.iso" || f.Size != 10 || len(f.Hashes) != 2 || f.Pieces == nil || len(f.Pieces.Hashes) != 3 || f.Pieces.Length != 4 {
+		t.Errorf("unexpected file %+v", f)
+	}
+	var hosts []string
+	for _, u := range f.URLs {
+		hosts = append(hosts, strings.Split(u.URL, "/")[2])
+	}
+	if got := strings.Join(hosts, " "); got != "us.example.com de.example.com ftp.example.com fallback.example.com" {
+		t.Errorf("URLs not ordered by priority: %s", got)
+	}
+
+	req, err := f.Request("downloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.Host != "us.example.com" || len(req.Mirrors) != 2 || req.Size != 10 || req.Dir != "downloads" {
+		t.Errorf("unexpected request %+v", req)
+	}
+	// Hashes of unsupported algorithms are skipped
+	if len(req.Checksums) != 1 || req.Checksums[0].Algorithm != "sha256" {
+		t.Errorf("expected the sha-256 hash, got %v", req.Checksums)
+	}
+	if req.Pieces == nil || req.Pieces.Algorithm != "sha1" || len(req.Pieces.Sums) != 3 {
+		t.Errorf("unexpected pieces %+v", req.Pieces)
+	}
+}
+
+func TestParseMetalink3(t *testing.T) {
+	m, err := Parse(strings.NewReader(metalink3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.Files[0]
+	if len(f.URLs) != 2 || !strings.Contains(f.URLs[0].URL, "high") {
+		t.Errorf("expected http URLs by preference, got %+v", f.URLs)
+	}
+	if len(f.Hashes) != 1 || f.Hashes[0].Type != "md5" {
+		t.Errorf("unexpected hashes %+v", f.Hashes)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, doc := range []string{
+		`not xml`,
+		`<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`,
+		`<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="../etc/passwd"></file></metalink>`,
+		`<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="/etc/passwd"></file></metalink>`,
+	} {
+		if _, err := Parse(strings.NewReader(doc)); err == nil {
+			t.Errorf("expected %s to be rejected", doc)
+		}
+	}
+}
+
+func TestIsMetalink(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"example.meta4":                        true,
+		"dir/example.METALINK":                 true,
+		"http://example.com/example.meta4?x=1": true,
+		"http://example.com/example.iso":       false,
+		"example.iso":                          false,
+	} {
+		if IsMetalink(name) != expected {
+			t.Errorf("IsMetalink(%q) expected %v", name, expected)
+		}
+	}
+}
+
+func TestOpenURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/example.meta4" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, meta4)
+	}))
+	defer server.Close()
+	client := download.NewClient(download.Options{HTTPClient: server.Client()})
+	m, err := Open(context.Background(), client, server.URL+"/example.meta4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 1 {
+		t.Errorf("expected 1 file, got %d", len(m.Files))
+	}
+	if _, err := Open(context.Background(), client, server.URL+"/missing.meta4"); err == nil {
+		t.Error("expected a missing metalink to fail")
+	}
+}
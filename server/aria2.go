@@ -0,0 +1,627 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stephng3/DoubleUp/download"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Version reported by aria2.getVersion, the aria2 release whose interface is followed
+const aria2Version = "1.37.0"
+
+// JSON-RPC 2.0 error codes. aria2 reports every failure of a method itself with code 1
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcFailure        = 1
+)
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func invalidParams(format string, a ...interface{}) *rpcError {
+	return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf(format, a...)}
+}
+
+// aria2States maps the status of a job to its aria2 counterpart
+var aria2States = map[Status]string{
+	Queued:    "waiting",
+	Running:   "active",
+	Paused:    "paused",
+	Completed: "complete",
+	Failed:    "error",
+	Cancelled: "removed",
+}
+
+// aria2Notifications are the notifications sent over a websocket when a job changes status
+var aria2Notifications = map[Status]string{
+	Running:   "aria2.onDownloadStart",
+	Paused:    "aria2.onDownloadPause",
+	Cancelled: "aria2.onDownloadStop",
+	Completed: "aria2.onDownloadComplete",
+	Failed:    "aria2.onDownloadError",
+}
+
+// gid is the aria2 GID of the job with id, 16 hex digits
+func gid(id string) string {
+	n, _ := strconv.ParseUint(id, 10, 64)
+	return fmt.Sprintf("%016x", n)
+}
+
+// jobID is the ID of the job with an aria2 GID
+func jobID(gid string) (string, error) {
+	n, err := strconv.ParseUint(gid, 16, 64)
+	if err != nil || len(gid) != 16 {
+		return "", invalidParams("invalid GID %s", gid)
+	}
+	return strconv.FormatUint(n, 10), nil
+}
+
+// ServeJSONRPC serves a subset of aria2's JSON-RPC interface, so that frontends made for aria2 can drive
+// the queue: aria2.addUri, remove, forceRemove, pause, forcePause, pauseAll, forcePauseAll, unpause,
+// unpauseAll, tellStatus, getUris, getFiles, tellActive, tellWaiting, tellStopped, getGlobalStat,
+// getGlobalOption, removeDownloadResult, purgeDownloadResult and getVersion, along with system.multicall,
+// system.listMethods and system.listNotifications. Calls are made by POST, or over a websocket, which
+// also receives aria2.onDownloadStart, onDownloadPause, onDownloadStop, onDownloadComplete and
+// onDownloadError notifications. Calls by POST have to be sent as application/json, and web pages
+// of other origins, or calls addressed to hosts other than the daemon's, are refused unless AllowOriginAll
+// is set, whether or not there is a Secret
+func (s *Server) ServeJSONRPC(w http.ResponseWriter, r *http.Request) {
+	if s.AllowOriginAll {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
+	switch {
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		websocket.Server{Handler: s.serveWebSocket, Handshake: s.handshake}.ServeHTTP(w, r)
+	case !s.allowOrigin(r):
+		writeError(w, http.StatusForbidden, errForeign)
+	case r.Method == http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost:
+		if !isJSON(r) {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("calls have to be sent as application/json"))
+			return
+		}
+		var body json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+				Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.handleRPC(body))
+	default:
+		methodNotAllowed(w, "POST")
+	}
+}
+
+// handshake refuses websockets opened by web pages of other origins, which browsers let any page do,
+// and those addressed to hosts other than the daemon's, as pages rebinding their name to it do
+func (s *Server) handshake(config *websocket.Config, r *http.Request) error {
+	if !s.allowOrigin(r) {
+		return errForeign
+	}
+	return nil
+}
+
+// serveWebSocket answers the calls received over ws and notifies it of jobs changing status
+func (s *Server) serveWebSocket(ws *websocket.Conn) {
+	var mu sync.Mutex
+	send := func(v interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return websocket.JSON.Send(ws, v)
+	}
+	changes, stop := s.watch()
+	defer stop()
+	go func() {
+		for job := range changes {
+			if method, ok := aria2Notifications[job.Status]; ok {
+				send(rpcNotification{JSONRPC: "2.0", Method: method, Params: []interface{}{map[string]string{"gid": gid(job.ID)}}})
+			}
+		}
+	}()
+	for {
+		var body json.RawMessage
+		if err := websocket.JSON.Receive(ws, &body); err != nil {
+			return
+		}
+		if err := send(s.handleRPC(body)); err != nil {
+			return
+		}
+	}
+}
+
+// handleRPC answers a call, or a batch of them
+func (s *Server) handleRPC(body json.RawMessage) interface{} {
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}}
+		}
+		responses := make([]rpcResponse, len(batch))
+		for i, call := range batch {
+			responses[i] = s.handleCall(call)
+		}
+		return responses
+	}
+	return s.handleCall(body)
+}
+
+func (s *Server) handleCall(body json.RawMessage) rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.Method == "" {
+		return rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}}
+	}
+	if req.ID == nil {
+		req.ID = json.RawMessage("null")
+	}
+	result, err := s.call(req.Method, req.Params)
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: rpcFailure, Message: err.Error()}
+		}
+		return rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: rpcErr}
+	}
+	return rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+}
+
+// aria2Methods are the aria2 methods served, taking their parameters after the secret token
+var aria2Methods = map[string]func(s *Server, params rpcParams) (interface{}, error){
+	"aria2.addUri":               (*Server).aria2AddURI,
+	"aria2.remove":               (*Server).aria2Remove,
+	"aria2.forceRemove":          (*Server).aria2Remove,
+	"aria2.pause":                (*Server).aria2Pause,
+	"aria2.forcePause":           (*Server).aria2Pause,
+	"aria2.pauseAll":             (*Server).aria2PauseAll,
+	"aria2.forcePauseAll":        (*Server).aria2PauseAll,
+	"aria2.unpause":              (*Server).aria2Unpause,
+	"aria2.unpauseAll":           (*Server).aria2UnpauseAll,
+	"aria2.tellStatus":           (*Server).aria2TellStatus,
+	"aria2.getUris":              (*Server).aria2GetURIs,
+	"aria2.getFiles":             (*Server).aria2GetFiles,
+	"aria2.tellActive":           (*Server).aria2TellActive,
+	"aria2.tellWaiting":          (*Server).aria2TellWaiting,
+	"aria2.tellStopped":          (*Server).aria2TellStopped,
+	"aria2.getGlobalStat":        (*Server).aria2GetGlobalStat,
+	"aria2.getGlobalOption":      (*Server).aria2GetGlobalOption,
+	"aria2.removeDownloadResult": (*Server).aria2RemoveDownloadResult,
+	"aria2.purgeDownloadResult":  (*Server).aria2PurgeDownloadResult,
+	"aria2.getVersion":           (*Server).aria2GetVersion,
+}
+
+// call calls method with params, checking the secret token
+func (s *Server) call(method string, params []json.RawMessage) (interface{}, error) {
+	switch method {
+	case "system.listMethods":
+		methods := []string{"system.listMethods", "system.listNotifications", "system.multicall"}
+		for name := range aria2Methods {
+			methods = append(methods, name)
+		}
+		return methods, nil
+	case "system.listNotifications":
+		var notifications []string
+		for _, name := range aria2Notifications {
+			notifications = append(notifications, name)
+		}
+		return notifications, nil
+	case "system.multicall":
+		return s.multicall(params)
+	}
+	handler, ok := aria2Methods[method]
+	if !ok {
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %s not found", method)}
+	}
+	// The secret comes first, as token:<secret>
+	var token, secret string
+	if len(params) > 0 && json.Unmarshal(params[0], &token) == nil && strings.HasPrefix(token, "token:") {
+		params, secret = params[1:], strings.TrimPrefix(token, "token:")
+	}
+	if !s.checkSecret(secret) {
+		return nil, &rpcError{Code: rpcFailure, Message: "Unauthorized"}
+	}
+	return handler(s, rpcParams(params))
+}
+
+// multicall makes every call of a system.multicall, answering each with [result] or an error
+func (s *Server) multicall(params []json.RawMessage) (interface{}, error) {
+	var calls []struct {
+		MethodName string            `json:"methodName"`
+		Params     []json.RawMessage `json:"params"`
+	}
+	if err := rpcParams(params).get(0, &calls, true); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, len(calls))
+	for i, c := range calls {
+		if c.MethodName == "system.multicall" {
+			results[i] = &rpcError{Code: rpcFailure, Message: "recursive system.multicall forbidden"}
+			continue
+		}
+		result, err := s.call(c.MethodName, c.Params)
+		if err != nil {
+			var rpcErr *rpcError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &rpcError{Code: rpcFailure, Message: err.Error()}
+			}
+			results[i] = rpcErr
+			continue
+		}
+		results[i] = []interface{}{result}
+	}
+	return results, nil
+}
+
+type rpcParams []json.RawMessage
+
+// get decodes parameter i into v, leaving v as it is if an optional parameter is missing
+func (p rpcParams) get(i int, v interface{}, required bool) error {
+	if i >= len(p) || string(p[i]) == "null" {
+		if required {
+			return invalidParams("missing parameter %d", i+1)
+		}
+		return nil
+	}
+	if err := json.Unmarshal(p[i], v); err != nil {
+		return invalidParams("invalid parameter %d: %v", i+1, err)
+	}
+	return nil
+}
+
+// id decodes the GID in the first parameter into the ID of its job
+func (p rpcParams) id() (string, error) {
+	var g string
+	if err := p.get(0, &g, true); err != nil {
+		return "", err
+	}
+	return jobID(g)
+}
+
+// keys decodes the keys in parameter i that a status is to be narrowed down to
+func (p rpcParams) keys(i int) ([]string, error) {
+	var keys []string
+	return keys, p.get(i, &keys, false)
+}
+
+// aria2AddURI adds a job downloading from uris, all pointing to the same resource.
+// The out, dir and checksum options are honoured, others are ignored
+func (s *Server) aria2AddURI(params rpcParams) (interface{}, error) {
+	var uris []string
+	var options map[string]interface{}
+	if err := params.get(0, &uris, true); err != nil {
+		return nil, err
+	}
+	if err := params.get(1, &options, false); err != nil {
+		return nil, err
+	}
+	if len(uris) == 0 {
+		return nil, invalidParams("no URI to download")
+	}
+	body := JobRequest{URL: uris[0], Mirrors: uris[1:]}
+	for name, value := range options {
+		v, ok := value.(string)
+		if !ok {
+			return nil, invalidParams("option %s should be a string", name)
+		}
+		switch name {
+		case "out":
+			body.Output = v
+		case "dir":
+			body.Dir = v
+		case "checksum":
+			// aria2 checksums are <type>=<digest>, with types such as sha-256
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) != 2 {
+				return nil, invalidParams("invalid checksum %q, should be <type>=<digest>", v)
+			}
+			body.Checksums = append(body.Checksums, strings.Replace(parts[0], "-", "", 1)+":"+parts[1])
+		}
+	}
+	req, err := body.Request()
+	if err != nil {
+		return nil, err
+	}
+	job, err := s.Add(req)
+	if err != nil {
+		return nil, err
+	}
+	return gid(job.ID), nil
+}
+
+func (s *Server) aria2Remove(params rpcParams) (interface{}, error) {
+	return s.aria2Do(params, s.Cancel)
+}
+
+func (s *Server) aria2Pause(params rpcParams) (interface{}, error) {
+	return s.aria2Do(params, s.Pause)
+}
+
+func (s *Server) aria2Unpause(params rpcParams) (interface{}, error) {
+	return s.aria2Do(params, s.Resume)
+}
+
+func (s *Server) aria2RemoveDownloadResult(params rpcParams) (interface{}, error) {
+	if _, err := s.aria2Do(params, s.Remove); err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
+
+// aria2Do applies action to the job of the GID in params, answering with the GID
+func (s *Server) aria2Do(params rpcParams, action func(id string) (Job, error)) (interface{}, error) {
+	id, err := params.id()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := action(id); err != nil {
+		return nil, fmt.Errorf("GID#%s: %v", gid(id), err)
+	}
+	return gid(id), nil
+}
+
+func (s *Server) aria2PauseAll(params rpcParams) (interface{}, error) {
+	for _, job := range s.Jobs() {
+		if job.Status == Queued || job.Status == Running {
+			s.Pause(job.ID)
+		}
+	}
+	return "OK", nil
+}
+
+func (s *Server) aria2UnpauseAll(params rpcParams) (interface{}, error) {
+	for _, job := range s.Jobs() {
+		if job.Status == Paused {
+			s.Resume(job.ID)
+		}
+	}
+	return "OK", nil
+}
+
+func (s *Server) aria2PurgeDownloadResult(params rpcParams) (interface{}, error) {
+	for _, job := range s.Jobs() {
+		s.Remove(job.ID)
+	}
+	return "OK", nil
+}
+
+func (s *Server) aria2TellStatus(params rpcParams) (interface{}, error) {
+	id, err := params.id()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := params.keys(1)
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.aria2Status(id)
+	if err != nil {
+		return nil, fmt.Errorf("GID#%s: %v", gid(id), err)
+	}
+	return narrow(status, keys), nil
+}
+
+func (s *Server) aria2GetURIs(params rpcParams) (interface{}, error) {
+	id, err := params.id()
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.aria2Status(id)
+	if err != nil {
+		return nil, fmt.Errorf("GID#%s: %v", gid(id), err)
+	}
+	return status["files"].([]map[string]interface{})[0]["uris"], nil
+}
+
+func (s *Server) aria2GetFiles(params rpcParams) (interface{}, error) {
+	id, err := params.id()
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.aria2Status(id)
+	if err != nil {
+		return nil, fmt.Errorf("GID#%s: %v", gid(id), err)
+	}
+	return status["files"], nil
+}
+
+func (s *Server) aria2TellActive(params rpcParams) (interface{}, error) {
+	keys, err := params.keys(0)
+	if err != nil {
+		return nil, err
+	}
+	return s.aria2List(keys, 0, -1, Running)
+}
+
+// aria2TellWaiting lists queued and paused jobs, from offset (counting back from the end if negative) up to num of them
+func (s *Server) aria2TellWaiting(params rpcParams) (interface{}, error) {
+	return s.aria2Window(params, Queued, Paused)
+}
+
+// aria2TellStopped lists completed, failed and cancelled jobs, like aria2TellWaiting
+func (s *Server) aria2TellStopped(params rpcParams) (interface{}, error) {
+	return s.aria2Window(params, Completed, Failed, Cancelled)
+}
+
+func (s *Server) aria2Window(params rpcParams, statuses ...Status) (interface{}, error) {
+	var offset, num int
+	if err := params.get(0, &offset, true); err != nil {
+		return nil, err
+	}
+	if err := params.get(1, &num, true); err != nil {
+		return nil, err
+	}
+	keys, err := params.keys(2)
+	if err != nil {
+		return nil, err
+	}
+	return s.aria2List(keys, offset, num, statuses...)
+}
+
+// aria2List lists the status of the jobs with one of statuses, num of them from offset, all of them if num is negative.
+// A negative offset counts back from the last job, listing them in reverse order
+func (s *Server) aria2List(keys []string, offset int, num int, statuses ...Status) ([]map[string]interface{}, error) {
+	var ids []string
+	for _, job := range s.Jobs() {
+		for _, status := range statuses {
+			if job.Status == status {
+				ids = append(ids, job.ID)
+			}
+		}
+	}
+	if offset < 0 {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+		offset = -offset - 1
+	}
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	ids = ids[offset:]
+	if num >= 0 && num < len(ids) {
+		ids = ids[:num]
+	}
+	list := []map[string]interface{}{}
+	for _, id := range ids {
+		if status, err := s.aria2Status(id); err == nil {
+			list = append(list, narrow(status, keys))
+		}
+	}
+	return list, nil
+}
+
+func (s *Server) aria2GetGlobalStat(params rpcParams) (interface{}, error) {
+	var speed int64
+	var active, waiting, stopped int
+	for _, job := range s.Jobs() {
+		speed += job.Speed
+		switch job.Status {
+		case Running:
+			active++
+		case Queued, Paused:
+			waiting++
+		default:
+			stopped++
+		}
+	}
+	return map[string]string{
+		"downloadSpeed":   strconv.FormatInt(speed, 10),
+		"uploadSpeed":     "0",
+		"numActive":       strconv.Itoa(active),
+		"numWaiting":      strconv.Itoa(waiting),
+		"numStopped":      strconv.Itoa(stopped),
+		"numStoppedTotal": strconv.Itoa(stopped),
+	}, nil
+}
+
+func (s *Server) aria2GetGlobalOption(params rpcParams) (interface{}, error) {
+	// The default directory is applied to every job added
+	var req download.Request
+	if s.prepare != nil {
+		s.prepare(&req)
+	}
+	return map[string]string{
+		"dir":                      req.Dir,
+		"max-concurrent-downloads": strconv.Itoa(s.files),
+		"split":                    strconv.Itoa(s.client.NThreads),
+	}, nil
+}
+
+func (s *Server) aria2GetVersion(params rpcParams) (interface{}, error) {
+	return map[string]interface{}{"version": aria2Version, "enabledFeatures": []string{}}, nil
+}
+
+// aria2Status describes the job with id the way aria2.tellStatus does, numbers as strings
+func (s *Server) aria2Status(id string) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	job := j.snapshot()
+	uris := []map[string]string{{"uri": job.URL, "status": "used"}}
+	for _, mirror := range j.req.Mirrors {
+		uris = append(uris, map[string]string{"uri": mirror.String(), "status": "waiting"})
+	}
+	path := job.Path
+	if path == "" && job.Output != "" {
+		path = job.Output
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(job.Dir, path)
+		}
+	}
+	status := map[string]interface{}{
+		"gid":             gid(job.ID),
+		"status":          aria2States[job.Status],
+		"totalLength":     strconv.FormatInt(job.Total, 10),
+		"completedLength": strconv.FormatInt(job.Completed, 10),
+		"uploadLength":    "0",
+		"downloadSpeed":   strconv.FormatInt(job.Speed, 10),
+		"uploadSpeed":     "0",
+		"dir":             job.Dir,
+		"files": []map[string]interface{}{{
+			"index":           "1",
+			"path":            path,
+			"length":          strconv.FormatInt(job.Total, 10),
+			"completedLength": strconv.FormatInt(job.Completed, 10),
+			"selected":        "true",
+			"uris":            uris,
+		}},
+	}
+	if job.Status == Failed {
+		status["errorCode"] = "1"
+		status["errorMessage"] = job.Error
+	}
+	return status, nil
+}
+
+// narrow leaves only keys in status, or all of it if there are none
+func narrow(status map[string]interface{}, keys []string) map[string]interface{} {
+	if len(keys) == 0 {
+		return status
+	}
+	narrowed := map[string]interface{}{}
+	for _, key := range keys {
+		if v, ok := status[key]; ok {
+			narrowed[key] = v
+		}
+	}
+	return narrowed
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stephng3/DoubleUp/download"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type rpcResult struct {
+	ID     json.RawMessage
+	Result json.RawMessage
+	Error  *rpcError
+}
+
+// rpc makes a JSON-RPC call over HTTP, decoding its result into v
+func rpc(t *testing.T, api string, method string, v interface{}, params ...interface{}) *rpcError {
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": "1", "method": method, "params": params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res rpcResult
+	call(t, http.MethodPost, api+"/jsonrpc", string(body), &res)
+	if res.Error != nil {
+		return res.Error
+	}
+	if v != nil {
+		if err := json.Unmarshal(res.Result, v); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+	}
+	return nil
+}
+
+func TestAria2(t *testing.T) {
+	gate := make(chan struct{})
+	files := fileServer(gate)
+	defer files.Close()
+	api, dir, cleanup := newTestServer(t)
+	defer cleanup()
+
+	var gid string
+	if err := rpc(t, api.URL, "aria2.addUri", &gid, []string{files.URL + "/gated", files.URL + "/mirror"}, map[string]string{"out": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if gid != "0000000000000001" {
+		t.Errorf("unexpected GID %s", gid)
+	}
+	var queued string
+	rpc(t, api.URL, "aria2.addUri", &queued, []string{files.URL + "/b"})
+
+	var active, waiting []map[string]interface{}
+	rpc(t, api.URL, "aria2.tellActive", &active, []string{"gid", "status"})
+	rpc(t, api.URL, "aria2.tellWaiting", &waiting, 0, 10)
+	if len(active) != 1 || active[0]["gid"] != gid || len(active[0]) != 2 || len(waiting) != 1 || waiting[0]["gid"] != queued {
+		t.Errorf("unexpected active %v and waiting %v downloads", active, waiting)
+	}
+	var uris []map[string]string
+	rpc(t, api.URL, "aria2.getUris", &uris, gid)
+	if len(uris) != 2 || uris[1]["uri"] != files.URL+"/mirror" {
+		t.Errorf("unexpected URIs %v", uris)
+	}
+
+	if err := rpc(t, api.URL, "aria2.pause", nil, gid); err != nil {
+		t.Fatal(err)
+	}
+	close(gate)
+	if err := rpc(t, api.URL, "aria2.unpause", nil, gid); err != nil {
+		t.Fatal(err)
+	}
+	var status map[string]interface{}
+	for i := 0; i < 500 && status["status"] != "complete"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		rpc(t, api.URL, "aria2.tellStatus", &status, gid)
+	}
+	files0 := status["files"].([]interface{})[0].(map[string]interface{})
+	if status["completedLength"] != fmt.Sprint(len(content)) || files0["path"] != dir+"/a" {
+		t.Errorf("unexpected status %v", status)
+	}
+
+	// Calls of a multicall fail on their own
+	var results []json.RawMessage
+	rpc(t, api.URL, "system.multicall", &results, []map[string]interface{}{
+		{"methodName": "aria2.getGlobalStat"},
+		{"methodName": "aria2.remove", "params": []string{gid}},
+		{"methodName": "aria2.nope"},
+	})
+	var stat []map[string]string
+	if len(results) != 3 || json.Unmarshal(results[0], &stat) != nil || stat[0]["numStopped"] == "" ||
+		!strings.Contains(string(results[1]), "GID#") || !strings.Contains(string(results[2]), fmt.Sprint(rpcMethodNotFound)) {
+		t.Errorf("unexpected multicall results %s", results)
+	}
+
+	if err := rpc(t, api.URL, "aria2.removeDownloadResult", nil, gid); err != nil {
+		t.Error(err)
+	}
+	if err := rpc(t, api.URL, "aria2.tellStatus", nil, gid); err == nil {
+		t.Error("expected a removed download result to be forgotten")
+	}
+	for _, c := range []struct {
+		method string
+		params []interface{}
+	}{
+		{"aria2.addUri", []interface{}{[]string{"ftp://example.com/a"}}},
+		{"aria2.addUri", []interface{}{[]string{files.URL}, map[string]string{"checksum": "sha-256"}}},
+		{"aria2.tellStatus", []interface{}{"123"}},
+		{"aria2.tellWaiting", []interface{}{0}},
+	} {
+		if err := rpc(t, api.URL, c.method, nil, c.params...); err == nil {
+			t.Errorf("%s %v: expected an error", c.method, c.params)
+		}
+	}
+}
+
+func TestAria2Secret(t *testing.T) {
+	jobs := New(download.NewClient(download.Options{}), 1, nil)
+	jobs.Secret = "s3cret"
+	api := httptest.NewServer(jobs)
+	defer api.Close()
+	defer jobs.Close()
+
+	var version map[string]interface{}
+	if err := rpc(t, api.URL, "aria2.getVersion", &version); err == nil || err.Message != "Unauthorized" {
+		t.Errorf("expected a call without the secret to be unauthorized, got %v", err)
+	}
+	if err := rpc(t, api.URL, "aria2.getVersion", &version, "token:s3cret"); err != nil || version["version"] == nil {
+		t.Errorf("expected a call with the secret to succeed, got %v %v", version, err)
+	}
+	var methods []string
+	if err := rpc(t, api.URL, "system.listMethods", &methods); err != nil || len(methods) == 0 {
+		t.Errorf("expected methods to be listed without the secret, got %v", err)
+	}
+}
+
+// Websocket clients can make calls and are notified of downloads changing status
+func TestAria2WebSocket(t *testing.T) {
+	files := fileServer(nil)
+	defer files.Close()
+	api, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(api.URL, "http")+"/jsonrpc", "", api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	call := map[string]interface{}{"jsonrpc": "2.0", "id": 7, "method": "aria2.addUri", "params": []interface{}{[]string{files.URL + "/a"}}}
+	if err := websocket.JSON.Send(ws, call); err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for len(methods) < 2 || methods[len(methods)-1] != "aria2.onDownloadComplete" {
+		var msg struct {
+			ID     json.RawMessage
+			Method string
+			Result string
+			Params []map[string]string
+		}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("got %v before the download completed: %v", methods, err)
+		}
+		if msg.Method == "" {
+			if string(msg.ID) != "7" || msg.Result != "0000000000000001" {
+				t.Errorf("unexpected response %+v", msg)
+			}
+			continue
+		}
+		if msg.Params[0]["gid"] != "0000000000000001" {
+			t.Errorf("unexpected notification %+v", msg)
+		}
+		methods = append(methods, msg.Method)
+	}
+	if methods[0] != "aria2.onDownloadStart" {
+		t.Errorf("expected the download to start first, got %v", methods)
+	}
+}
+
+// Web pages of other origins cannot make calls, and downloads stay inside the daemon's directory
+func TestAria2RequestChecks(t *testing.T) {
+	api, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if _, err := websocket.Dial("ws"+strings.TrimPrefix(api.URL, "http")+"/jsonrpc", "", "http://evil.example"); err == nil {
+		t.Error("expected a websocket of another origin to be refused")
+	}
+	body := `{"jsonrpc": "2.0", "id": "1", "method": "aria2.getVersion"}`
+
+	// A page whose name was rebound to the daemon's address sends a matching Origin and Host
+	rebound := "rebound.example" + api.URL[strings.LastIndex(api.URL, ":"):]
+	req, err := http.NewRequest(http.MethodPost, api.URL+"/jsonrpc", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = rebound
+	req.Header.Set("Origin", "http://"+rebound)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a call to a rebound host to be refused, got %d", res.StatusCode)
+	}
+	config, err := websocket.NewConfig("ws://"+rebound+"/jsonrpc", "http://"+rebound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", strings.TrimPrefix(api.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := websocket.NewClient(config, conn); err == nil {
+		t.Error("expected a websocket to a rebound host to be refused")
+	}
+
+	for contentType, status := range map[string]int{"text/plain": http.StatusUnsupportedMediaType, "application/json; charset=utf-8": http.StatusOK} {
+		res, err := http.Post(api.URL+"/jsonrpc", contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("%s: expected %d, got %d", contentType, status, res.StatusCode)
+		}
+	}
+	for _, options := range []map[string]string{{"dir": "/etc"}, {"out": "../a"}} {
+		if err := rpc(t, api.URL, "aria2.addUri", nil, []string{"http://example.com/a"}, options); err == nil {
+			t.Errorf("%v: expected the download to be refused", options)
+		}
+	}
+}
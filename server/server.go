@@ -0,0 +1,587 @@
+// Package server runs a long-lived queue of downloads, managed over a local HTTP/JSON API
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stephng3/DoubleUp/download"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status is where a Job is in its lifecycle
+type Status string
+
+const (
+	Queued    Status = "queued"    // Waiting for a free slot
+	Running   Status = "running"   // Downloading
+	Paused    Status = "paused"    // Stopped, its saved progress kept to resume from
+	Completed Status = "completed" // Downloaded and verified
+	Failed    Status = "failed"    // Stopped by an error, see Job.Error
+	Cancelled Status = "cancelled" // Stopped for good, whatever was downloaded is left in place
+)
+
+var (
+	ErrNotFound     = errors.New("no such job")
+	ErrInvalidState = errors.New("invalid job state")
+	ErrClosed       = errors.New("server closed")
+)
+
+// errForeign refuses requests of web pages of other origins, or addressed to hosts other than the daemon's
+var errForeign = errors.New("requests from other origins or to other hosts are not allowed")
+
+// Job is a download of the queue as reported by the API
+type Job struct {
+	ID        string     `json:"id"`
+	URL       string     `json:"url"`
+	Output    string     `json:"output,omitempty"`
+	Dir       string     `json:"dir,omitempty"`
+	Status    Status     `json:"status"`
+	Completed int64      `json:"completed"`      // Bytes downloaded so far
+	Total     int64      `json:"total"`          // Size of the resource, 0 until known
+	Speed     int64      `json:"speed"`          // Average bytes/s since the job last started, 0 unless running
+	Path      string     `json:"path,omitempty"` // Where the resource was saved, once completed
+	Error     string     `json:"error,omitempty"`
+	Created   time.Time  `json:"created"`
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+// job is a Job along with what it takes to run it
+type job struct {
+	Job
+	req    download.Request
+	cancel context.CancelFunc // Stops the running download, nil if not running
+	done   chan struct{}      // Closed once the running download has returned
+	stopAs Status             // Status to take once the cancelled download returns
+
+	started      time.Time // When the download last started
+	startedBytes int64     // Bytes already downloaded when it started
+}
+
+// snapshot is the Job as it stands. s.mu must be held
+func (j *job) snapshot() Job {
+	job := j.Job
+	if elapsed := time.Since(j.started).Seconds(); j.Status == Running && elapsed > 0 {
+		job.Speed = int64(float64(j.Completed-j.startedBytes) / elapsed)
+	}
+	return job
+}
+
+// progress updates the bytes of the job from the events reporting them. s.mu must be held
+func (j *job) progress(e download.Event) {
+	switch e.Type {
+	case download.EventStarted, download.EventChunkCompleted, download.EventProgress, download.EventFinished:
+		j.Completed = e.Completed
+		if e.Total > 0 {
+			j.Total = e.Total
+		}
+	}
+}
+
+// Server downloads the jobs added to it over a shared Client, up to a number of them at a time
+type Server struct {
+	// Secret, if set, has to be passed as "Authorization: Bearer <Secret>" with every API request and as
+	// "token:<Secret>" in the first parameter of every JSON-RPC call, like aria2's --rpc-secret. Set it before serving
+	Secret string
+	// AllowOriginAll lets web pages of any origin make requests, which are otherwise only taken from
+	// the same origin or clients that are not browsers. Set it before serving
+	AllowOriginAll bool
+	// Addr is the <host>:<port> the server listens on. Requests have to be sent to its host, localhost
+	// or a loopback address unless AllowOriginAll is set. Set it before serving
+	Addr string
+
+	client  *download.Client
+	files   int
+	prepare func(req *download.Request)
+
+	ctx   context.Context
+	close context.CancelFunc
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	jobs    map[string]*job
+	order   []*job // Jobs in the order they were added
+	nextID  int
+	running int
+	closed  bool
+
+	watchers map[chan Job]struct{}
+}
+
+// New returns a Server downloading up to files jobs at a time with client.
+// prepare, if not nil, is applied to the request of every job added, e.g. to set defaults
+func New(client *download.Client, files int, prepare func(req *download.Request)) *Server {
+	if files < 1 {
+		files = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		client:  client,
+		files:   files,
+		prepare: prepare,
+		ctx:     ctx,
+		close:   cancel,
+		jobs:    map[string]*job{},
+
+		watchers: map[chan Job]struct{}{},
+	}
+}
+
+// Add queues a download, starting it once there is a free slot
+func (s *Server) Add(req download.Request) (Job, error) {
+	if s.prepare != nil {
+		s.prepare(&req)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return Job{}, ErrClosed
+	}
+	s.nextID++
+	j := &job{
+		Job: Job{
+			ID:      strconv.Itoa(s.nextID),
+			URL:     req.URL.String(),
+			Output:  req.Output,
+			Dir:     req.Dir,
+			Status:  Queued,
+			Created: time.Now(),
+		},
+		req: req,
+	}
+	j.req.Events = func(e download.Event) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j.progress(e)
+	}
+	s.jobs[j.ID] = j
+	s.order = append(s.order, j)
+	s.startQueued()
+	return j.snapshot(), nil
+}
+
+// Jobs lists every job in the order they were added
+func (s *Server) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]Job, len(s.order))
+	for i, j := range s.order {
+		jobs[i] = j.snapshot()
+	}
+	return jobs
+}
+
+// Job looks up a job by its ID
+func (s *Server) Job(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return j.snapshot(), nil
+}
+
+// Pause stops a queued or running job, keeping the progress of a running one to resume from
+func (s *Server) Pause(id string) (Job, error) {
+	return s.stop(id, Paused)
+}
+
+// Cancel stops a job for good. What it downloaded is left in place
+func (s *Server) Cancel(id string) (Job, error) {
+	return s.stop(id, Cancelled)
+}
+
+func (s *Server) stop(id string, status Status) (Job, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		return Job{}, ErrNotFound
+	}
+	switch {
+	case j.Status == Queued || (j.Status == Paused && status == Cancelled):
+		j.Status = status
+		if status == Cancelled {
+			j.finish()
+		}
+		s.changed(j)
+		job := j.snapshot()
+		s.mu.Unlock()
+		return job, nil
+	case j.Status != Running:
+		s.mu.Unlock()
+		return Job{}, fmt.Errorf("%w: job %s is %s", ErrInvalidState, id, j.Status)
+	}
+	// Wait for the download to return, so that the job is not resumed while its files are still in use
+	j.stopAs = status
+	j.cancel()
+	done := j.done
+	s.mu.Unlock()
+	<-done
+	return s.Job(id)
+}
+
+// Resume queues a paused job again, picking up its saved progress
+func (s *Server) Resume(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	if j.Status != Paused {
+		return Job{}, fmt.Errorf("%w: job %s is %s", ErrInvalidState, id, j.Status)
+	}
+	j.Status, j.Error = Queued, ""
+	j.req.Resume = true
+	s.startQueued()
+	return j.snapshot(), nil
+}
+
+// Remove forgets a job that has stopped for good, completed, failed or cancelled
+func (s *Server) Remove(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	if !j.stopped() {
+		return Job{}, fmt.Errorf("%w: job %s is %s", ErrInvalidState, id, j.Status)
+	}
+	delete(s.jobs, id)
+	for i, other := range s.order {
+		if other == j {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return j.snapshot(), nil
+}
+
+// stopped is whether the job has stopped for good
+func (j *job) stopped() bool {
+	return j.Status == Completed || j.Status == Failed || j.Status == Cancelled
+}
+
+// watch returns a channel receiving every job whose status changes, until stop is called.
+// Changes are dropped while the channel is full
+func (s *Server) watch() (changes <-chan Job, stop func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := make(chan Job, 64)
+	s.watchers[c] = struct{}{}
+	return c, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.watchers[c]; ok {
+			delete(s.watchers, c)
+			close(c)
+		}
+	}
+}
+
+// changed tells the watchers about a change of the status of j. s.mu must be held
+func (s *Server) changed(j *job) {
+	job := j.snapshot()
+	for c := range s.watchers {
+		select {
+		case c <- job:
+		default:
+		}
+	}
+}
+
+// Close stops every running job and waits for them to return. Jobs cannot be added afterwards
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for _, j := range s.order {
+		if j.Status == Running {
+			j.stopAs = Paused
+		}
+	}
+	s.mu.Unlock()
+	s.close()
+	s.wg.Wait()
+}
+
+// startQueued starts the oldest queued jobs while there are free slots. s.mu must be held
+func (s *Server) startQueued() {
+	for _, j := range s.order {
+		if s.running >= s.files || s.closed {
+			return
+		}
+		if j.Status != Queued {
+			continue
+		}
+		var ctx context.Context
+		ctx, j.cancel = context.WithCancel(s.ctx)
+		j.done = make(chan struct{})
+		j.Status = Running
+		j.started, j.startedBytes = time.Now(), j.Completed
+		s.changed(j)
+		s.running++
+		s.wg.Add(1)
+		go s.run(ctx, j, j.done)
+	}
+}
+
+func (s *Server) run(ctx context.Context, j *job, done chan struct{}) {
+	defer s.wg.Done()
+	defer close(done)
+	res, err := s.client.Download(ctx, j.req)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.cancel()
+	j.cancel, j.done = nil, nil
+	s.running--
+	switch {
+	case err == nil:
+		j.Status, j.Path = Completed, res.Path
+		j.Completed, j.Total = res.Bytes, res.Bytes
+		j.finish()
+	case j.stopAs != "":
+		j.Status, j.stopAs = j.stopAs, ""
+		if j.Status == Cancelled {
+			j.finish()
+		}
+	default:
+		j.Status, j.Error = Failed, err.Error()
+		j.finish()
+	}
+	s.changed(j)
+	s.startQueued()
+}
+
+func (j *job) finish() {
+	now := time.Now()
+	j.Finished = &now
+}
+
+// JobRequest is the body of a request adding a job
+type JobRequest struct {
+	URL       string   `json:"url"`
+	Mirrors   []string `json:"mirrors,omitempty"`
+	Output    string   `json:"output,omitempty"`
+	Dir       string   `json:"dir,omitempty"`
+	Checksums []string `json:"checksums,omitempty"` // <algorithm>:<hex>
+}
+
+// Request validates r, turning it into the request of a download
+func (r JobRequest) Request() (req download.Request, err error) {
+	if req.URL, err = download.ParseURL(r.URL); err != nil {
+		return req, err
+	}
+	for _, mirror := range r.Mirrors {
+		u, err := download.ParseURL(mirror)
+		if err != nil {
+			return req, fmt.Errorf("invalid mirror %s: %w", mirror, err)
+		}
+		req.Mirrors = append(req.Mirrors, u)
+	}
+	for _, checksumString := range r.Checksums {
+		checksum, err := download.ParseChecksum(checksumString)
+		if err != nil {
+			return req, err
+		}
+		req.Checksums = append(req.Checksums, checksum)
+	}
+	if r.Output == download.Stdout {
+		return req, errors.New("a job cannot be written to stdout")
+	}
+	for _, path := range []string{r.Output, r.Dir} {
+		if path != "" && !isLocal(path) {
+			return req, fmt.Errorf("%s is outside the download directory, should be a relative path without ..", path)
+		}
+	}
+	req.Output, req.Dir = r.Output, r.Dir
+	return req, nil
+}
+
+// isLocal reports whether path stays inside the directory it is relative to:
+// neither absolute, on another volume nor climbing out of it with ..
+func isLocal(path string) bool {
+	if filepath.IsAbs(path) || filepath.VolumeName(path) != "" || strings.HasPrefix(path, string(filepath.Separator)) {
+		return false
+	}
+	path = filepath.Clean(path)
+	return path != ".." && !strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// ServeHTTP serves the API:
+//
+//	POST /jobs              add a job from a JobRequest
+//	GET  /jobs              list every job
+//	GET  /jobs/{id}         get a job and its progress
+//	POST /jobs/{id}/pause   pause a job
+//	POST /jobs/{id}/resume  resume a paused job
+//	POST /jobs/{id}/cancel  cancel a job
+//	DELETE /jobs/{id}       remove a completed, failed or cancelled job
+//
+// Jobs are answered as Job, errors as {"error": "..."}. Requests have to pass the Secret, if any,
+// POST /jobs has to be sent as application/json and web pages of other origins are turned away.
+// An aria2 compatible JSON-RPC interface is served at /jsonrpc, see ServeJSONRPC
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/jsonrpc" {
+		s.ServeJSONRPC(w, r)
+		return
+	}
+	if !s.allowOrigin(r) {
+		writeError(w, http.StatusForbidden, errForeign)
+		return
+	}
+	if auth := r.Header.Get("Authorization"); s.Secret != "" && !s.checkSecret(strings.TrimPrefix(auth, "Bearer ")) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("missing or wrong secret"))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "jobs" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	switch len(parts) {
+	case 1:
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.Jobs())
+		case http.MethodPost:
+			if !isJSON(r) {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("jobs have to be sent as application/json"))
+				return
+			}
+			var body JobRequest
+			decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&body); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			req, err := body.Request()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			j, err := s.Add(req)
+			writeResult(w, http.StatusCreated, j, err)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	case 2:
+		switch r.Method {
+		case http.MethodGet:
+			j, err := s.Job(parts[1])
+			writeResult(w, http.StatusOK, j, err)
+		case http.MethodDelete:
+			j, err := s.Remove(parts[1])
+			writeResult(w, http.StatusOK, j, err)
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	case 3:
+		actions := map[string]func(string) (Job, error){"pause": s.Pause, "resume": s.Resume, "cancel": s.Cancel}
+		action, ok := actions[parts[2]]
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		j, err := action(parts[1])
+		writeResult(w, http.StatusOK, j, err)
+	}
+}
+
+// writeResult writes j with status, or err with the status matching it
+func writeResult(w http.ResponseWriter, status int, j Job, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, status, j)
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrInvalidState):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrClosed):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// allowOrigin reports whether r may be served: requests sent by web pages have to come from the same origin,
+// unless AllowOriginAll is set, so that pages the user visits cannot drive the daemon over loopback
+func (s *Server) allowOrigin(r *http.Request) bool {
+	if s.AllowOriginAll {
+		return true
+	}
+	// A page can rebind its own name to the daemon's address, its origin then matching the Host it sends.
+	// Only names the daemon is known by are taken as the Host to keep such pages out
+	if !s.allowHost(r.Host) {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// allowHost reports whether host, of the Host header of a request, names the daemon:
+// localhost, a loopback address or the host of Addr
+func (s *Server) allowHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	addr, _, err := net.SplitHostPort(s.Addr)
+	return err == nil && addr != "" && strings.EqualFold(host, addr)
+}
+
+// checkSecret reports whether secret is the Secret, if one is set
+func (s *Server) checkSecret(secret string) bool {
+	return s.Secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.Secret)) == 1
+}
+
+// isJSON reports whether the body of r is sent as application/json, which web pages cannot send
+// to other origins without asking first
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
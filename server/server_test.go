@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stephng3/DoubleUp/download"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Content served by the test file server
+var content = func() []byte {
+	b := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}()
+
+// fileServer serves content at any path. GET requests to /gated wait for gate to be closed
+func fileServer(gate chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/gated" && r.Method == http.MethodGet {
+			select {
+			case <-gate:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func newTestServer(t *testing.T) (api *httptest.Server, dir string, cleanup func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "server_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := download.NewClient(download.Options{NThreads: 4, ChunkSize: 64 << 10})
+	jobs := New(client, 1, func(req *download.Request) { req.Dir = dir })
+	api = httptest.NewServer(jobs)
+	return api, dir, func() {
+		api.Close()
+		jobs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// call makes an API request, decoding the response into v
+func call(t *testing.T, method string, url string, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+// waitFor polls a job until it has status
+func waitFor(t *testing.T, api string, id string, status Status) Job {
+	var job Job
+	for i := 0; i < 500; i++ {
+		call(t, http.MethodGet, api+"/jobs/"+id, "", &job)
+		if job.Status == status {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s still %s, expected %s: %s", id, job.Status, status, job.Error)
+	return job
+}
+
+func TestJobs(t *testing.T) {
+	files := fileServer(nil)
+	defer files.Close()
+	api, dir, cleanup := newTestServer(t)
+	defer cleanup()
+
+	var job Job
+	if status := call(t, http.MethodPost, api.URL+"/jobs", fmt.Sprintf(`{"url": %q, "output": "a"}`, files.URL+"/a"), &job); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	job = waitFor(t, api.URL, job.ID, Completed)
+	if job.Path != filepath.Join(dir, "a") || job.Completed != int64(len(content)) || job.Total != job.Completed {
+		t.Errorf("unexpected completed job %+v", job)
+	}
+	if b, err := ioutil.ReadFile(job.Path); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("downloaded file does not match, %v", err)
+	}
+
+	call(t, http.MethodPost, api.URL+"/jobs", fmt.Sprintf(`{"url": %q}`, files.URL+"/missing"), &job)
+	if job = waitFor(t, api.URL, job.ID, Failed); job.Error == "" {
+		t.Error("expected the failed job to report its error")
+	}
+	var jobs []Job
+	call(t, http.MethodGet, api.URL+"/jobs", "", &jobs)
+	if len(jobs) != 2 || jobs[0].ID != "1" || jobs[1].ID != "2" {
+		t.Errorf("expected both jobs in order, got %+v", jobs)
+	}
+
+	if status := call(t, http.MethodDelete, api.URL+"/jobs/2", "", &job); status != http.StatusOK {
+		t.Errorf("expected the failed job to be removed, got %d", status)
+	}
+	if status := call(t, http.MethodGet, api.URL+"/jobs/2", "", nil); status != http.StatusNotFound {
+		t.Errorf("expected the removed job to be forgotten, got %d", status)
+	}
+
+	var apiErr struct{ Error string }
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/jobs", `{"url": "ftp://example.com/a"}`, http.StatusBadRequest},
+		{http.MethodPost, "/jobs", `{"url": "http://example.com/a", "checksums": ["md5:00"]}`, http.StatusBadRequest},
+		{http.MethodPost, "/jobs", `{"uri": "http://example.com/a"}`, http.StatusBadRequest},
+		{http.MethodGet, "/jobs/9", "", http.StatusNotFound},
+		{http.MethodPost, "/jobs/1/resume", "", http.StatusConflict},
+		{http.MethodPost, "/jobs/1/stop", "", http.StatusNotFound},
+		{http.MethodDelete, "/jobs", "", http.StatusMethodNotAllowed},
+	} {
+		if status := call(t, c.method, api.URL+c.path, c.body, &apiErr); status != c.status || apiErr.Error == "" {
+			t.Errorf("%s %s %s: expected %d with an error, got %d", c.method, c.path, c.body, c.status, status)
+		}
+	}
+}
+
+// A paused job keeps its progress and picks it up again once resumed
+// Only the events reporting progress move the bytes of a job
+func TestJobProgress(t *testing.T) {
+	j := &job{}
+	for _, e := range []download.Event{
+		{Type: download.EventStarted, Completed: 100, Total: 1000},
+		{Type: download.EventProgress, Completed: 500, Total: 1000},
+		{Type: download.EventNotice, Message: "restarting download"},
+		{Type: download.EventFailed, Err: download.ErrStalled},
+	} {
+		j.progress(e)
+	}
+	if j.Completed != 500 || j.Total != 1000 {
+		t.Errorf("expected 500 of 1000 bytes, got %d of %d", j.Completed, j.Total)
+	}
+}
+
+func TestPauseResumeCancel(t *testing.T) {
+	gate := make(chan struct{})
+	files := fileServer(gate)
+	defer files.Close()
+	api, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	var running, queued Job
+	call(t, http.MethodPost, api.URL+"/jobs", fmt.Sprintf(`{"url": %q}`, files.URL+"/gated"), &running)
+	call(t, http.MethodPost, api.URL+"/jobs", fmt.Sprintf(`{"url": %q, "output": "b"}`, files.URL+"/b"), &queued)
+	waitFor(t, api.URL, running.ID, Running)
+	if queued.Status != Queued {
+		t.Errorf("expected the second job to wait for the first, got %s", queued.Status)
+	}
+
+	var job Job
+	if status := call(t, http.MethodPost, api.URL+"/jobs/"+running.ID+"/pause", "", &job); status != http.StatusOK || job.Status != Paused {
+		t.Fatalf("expected the job to be paused, got %d %+v", status, job)
+	}
+	waitFor(t, api.URL, queued.ID, Completed)
+
+	close(gate)
+	if call(t, http.MethodPost, api.URL+"/jobs/"+running.ID+"/resume", "", &job); job.Status == Paused {
+		t.Fatalf("expected the job to be resumed, got %+v", job)
+	}
+	job = waitFor(t, api.URL, running.ID, Completed)
+	if b, err := ioutil.ReadFile(job.Path); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("resumed file does not match, %v", err)
+	}
+
+	call(t, http.MethodPost, api.URL+"/jobs/"+queued.ID+"/cancel", "", &job)
+	if status := call(t, http.MethodPost, api.URL+"/jobs/"+queued.ID+"/cancel", "", nil); status != http.StatusConflict {
+		t.Errorf("expected a completed job not to be cancelled, got %d", status)
+	}
+	gate = make(chan struct{})
+	gated := fileServer(gate)
+	defer gated.Close()
+	call(t, http.MethodPost, api.URL+"/jobs", fmt.Sprintf(`{"url": %q, "output": "c"}`, gated.URL+"/gated"), &job)
+	waitFor(t, api.URL, job.ID, Running)
+	if call(t, http.MethodPost, api.URL+"/jobs/"+job.ID+"/cancel", "", &job); job.Status != Cancelled || job.Finished == nil {
+		t.Errorf("expected the job to be cancelled, got %+v", job)
+	}
+}
+
+// Requests web pages could send to the daemon, and jobs writing outside of its directory, are refused
+func TestIsLocal(t *testing.T) {
+	for path, local := range map[string]bool{"a": true, "a/b": true, "a/../b": true, "a/..": true, "..a": true,
+		"/etc/passwd": false, "..": false, "../a": false, "a/../../b": false} {
+		if isLocal(path) != local {
+			t.Errorf("%s: expected local %v", path, local)
+		}
+	}
+}
+
+func TestRequestChecks(t *testing.T) {
+	api, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	send := func(method string, path string, body string, header map[string]string) int {
+		req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		req.Host = req.Header.Get("Host")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	port := api.URL[strings.LastIndex(api.URL, ":"):]
+	rebound := "rebound.example" + port
+	jsonType := map[string]string{"Content-Type": "application/json"}
+	for _, c := range []struct {
+		body   string
+		header map[string]string
+		status int
+	}{
+		{`{"url": "http://example.com/a"}`, map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{`{"url": "http://example.com/a"}`, map[string]string{"Content-Type": "application/json", "Origin": "http://evil.example"}, http.StatusForbidden},
+		{`{"url": "http://example.com/a", "output": "/home/user/.bashrc"}`, jsonType, http.StatusBadRequest},
+		{`{"url": "http://example.com/a", "dir": "../.."}`, jsonType, http.StatusBadRequest},
+		{`{"url": "http://example.com/a", "output": "a/../../b"}`, jsonType, http.StatusBadRequest},
+		// A page whose name was rebound to the daemon's address sends a matching Origin and Host
+		{`{"url": "http://example.com/a"}`, map[string]string{"Content-Type": "application/json", "Origin": "http://" + rebound, "Host": rebound}, http.StatusForbidden},
+		{`{"url": "http://example.com/a"}`, map[string]string{"Content-Type": "application/json", "Host": rebound}, http.StatusForbidden},
+	} {
+		if status := send(http.MethodPost, "/jobs", c.body, c.header); status != c.status {
+			t.Errorf("%s %v: expected %d, got %d", c.body, c.header, c.status, status)
+		}
+	}
+	if status := send(http.MethodGet, "/jobs", "", map[string]string{"Origin": api.URL}); status != http.StatusOK {
+		t.Errorf("expected a request of the same origin to be served, got %d", status)
+	}
+	if status := send(http.MethodGet, "/jobs", "", map[string]string{"Host": "localhost" + port}); status != http.StatusOK {
+		t.Errorf("expected a request to localhost to be served, got %d", status)
+	}
+
+	jobs := New(download.NewClient(download.Options{}), 1, nil)
+	// The host the daemon listens on is accepted besides loopback names
+	jobs.Addr = "192.0.2.1:6800"
+	for host, allowed := range map[string]bool{"192.0.2.1:6800": true, "[::1]:6800": true, "LOCALHOST": true, "192.0.2.2:6800": false, "example.com": false} {
+		if jobs.allowHost(host) != allowed {
+			t.Errorf("Host %s: expected allowed %v", host, allowed)
+		}
+	}
+	jobs.Secret = "s3cret"
+	secured := httptest.NewServer(jobs)
+	defer secured.Close()
+	defer jobs.Close()
+	for header, status := range map[string]int{"": http.StatusUnauthorized, "Bearer nope": http.StatusUnauthorized, "Bearer s3cret": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodGet, secured.URL+"/jobs", nil)
+		req.Header.Set("Authorization", header)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("Authorization %q: expected %d, got %d", header, status, res.StatusCode)
+		}
+	}
+}